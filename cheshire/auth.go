@@ -0,0 +1,137 @@
+package cheshire
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/trendrr/goshire/dynmap"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Json, binary and websocket connections can be authenticated once, with
+// credentials sent in the hello under "auth".  i.e.
+// {"strest" : {"hello" : {"auth" : {"api_key" : "..."}}}}
+// Http requests are not authenticated this way.
+
+// The status sent to a client that fails to authenticate
+const UnauthorizedStatus = 401
+
+// Validates the credentials sent in the hello.
+// Set as ServerConfig.Authenticator
+type ConnectionAuthenticator interface {
+	//returns the authenticated client, or an error to reject the connection
+	Authenticate(credentials *dynmap.DynMap) (*Principal, error)
+}
+
+// The authenticated client of a connection, available to controllers
+// and filters as txn.Principal
+type Principal struct {
+	//identifies the client, i.e. the api key owner
+	Id string
+	//anything else the authenticator knows about the client
+	Attributes *dynmap.DynMap
+}
+
+func NewPrincipal(id string) *Principal {
+	return &Principal{
+		Id:         id,
+		Attributes: dynmap.New(),
+	}
+}
+
+// Adapts a func to a ConnectionAuthenticator
+type AuthenticatorFunc func(credentials *dynmap.DynMap) (*Principal, error)
+
+func (this AuthenticatorFunc) Authenticate(credentials *dynmap.DynMap) (*Principal, error) {
+	return this(credentials)
+}
+
+// Authenticates clients that send a known "api_key"
+type ApiKeyAuthenticator struct {
+	//api key to principal id
+	Keys map[string]string
+}
+
+func (this *ApiKeyAuthenticator) Authenticate(credentials *dynmap.DynMap) (*Principal, error) {
+	key := credentials.MustString("api_key", "")
+	id, ok := this.Keys[key]
+	if key == "" || !ok {
+		return nil, fmt.Errorf("Invalid api key")
+	}
+	return NewPrincipal(id), nil
+}
+
+// Authenticates clients that send a "token" signed with the shared secret,
+// see NewHmacToken
+type HmacAuthenticator struct {
+	Secret []byte
+	//tokens older (or further in the future) then this are refused, 0 for no limit
+	MaxAge time.Duration
+}
+
+func (this *HmacAuthenticator) Authenticate(credentials *dynmap.DynMap) (*Principal, error) {
+	//split from the right, the principal may contain colons
+	token := credentials.MustString("token", "")
+	sig := strings.LastIndex(token, ":")
+	if sig <= 0 {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	ts := strings.LastIndex(token[:sig], ":")
+	if ts <= 0 {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	id, timestamp, signature := token[:ts], token[ts+1:sig], token[sig+1:]
+	expected := hmacSignature(this.Secret, id+":"+timestamp)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	age := time.Since(time.Unix(seconds, 0))
+	if this.MaxAge > 0 && (age > this.MaxAge || age < -this.MaxAge) {
+		return nil, fmt.Errorf("Token expired")
+	}
+	return NewPrincipal(id), nil
+}
+
+// Creates a token for the principal, signed with the shared secret.
+// The token is principal:unix seconds:base64 (url, unpadded) hmac-sha256 of principal:unix seconds
+func NewHmacToken(secret []byte, principal string, t time.Time) string {
+	signed := principal + ":" + strconv.FormatInt(t.Unix(), 10)
+	return signed + ":" + hmacSignature(secret, signed)
+}
+
+func hmacSignature(secret []byte, value string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Authenticates the connection with the credentials in its hello,
+// setting the principal for its txns.  The credentials are removed from
+// the hello so controllers never see them.
+// Without an authenticator every connection is accepted with no principal.
+func (this *connState) authenticate(hello *dynmap.DynMap, serverConfig *ServerConfig) error {
+	credentials, ok := hello.GetDynMap("auth")
+	if !ok {
+		credentials = dynmap.New()
+	}
+	hello.Remove("auth")
+	if serverConfig.Authenticator == nil {
+		return nil
+	}
+	principal, err := serverConfig.Authenticator.Authenticate(credentials)
+	if err != nil {
+		return err
+	}
+	if principal == nil {
+		return fmt.Errorf("Not authenticated")
+	}
+	this.principal = principal
+	return nil
+}
@@ -0,0 +1,100 @@
+package cheshire
+
+import (
+	"github.com/trendrr/goshire/dynmap"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticators(t *testing.T) {
+	credentials := func(key, value string) *dynmap.DynMap {
+		mp := dynmap.New()
+		mp.Put(key, value)
+		return mp
+	}
+
+	keys := &ApiKeyAuthenticator{Keys: map[string]string{"secret-key": "dustin"}}
+	principal, err := keys.Authenticate(credentials("api_key", "secret-key"))
+	if err != nil || principal.Id != "dustin" {
+		t.Errorf("Expected dustin, got %v %s", principal, err)
+	}
+	for _, key := range []string{"", "wrong"} {
+		_, err = keys.Authenticate(credentials("api_key", key))
+		if err == nil {
+			t.Errorf("Expected an error for key %q", key)
+		}
+	}
+
+	secret := []byte("shared")
+	hmacs := &HmacAuthenticator{Secret: secret, MaxAge: time.Minute}
+	principal, err = hmacs.Authenticate(credentials("token", NewHmacToken(secret, "dustin", time.Now())))
+	if err != nil || principal.Id != "dustin" {
+		t.Errorf("Expected dustin, got %v %s", principal, err)
+	}
+	principal, err = hmacs.Authenticate(credentials("token", NewHmacToken(secret, "user:10", time.Now())))
+	if err != nil || principal.Id != "user:10" {
+		t.Errorf("Expected user:10, got %v %s", principal, err)
+	}
+	bad := map[string]string{
+		"expired":  NewHmacToken(secret, "dustin", time.Now().Add(-time.Hour)),
+		"future":   NewHmacToken(secret, "dustin", time.Now().Add(time.Hour)),
+		"secret":   NewHmacToken([]byte("other"), "dustin", time.Now()),
+		"tampered": strings.Replace(NewHmacToken(secret, "dustin", time.Now()), "dustin", "admin", 1),
+		"garbage":  "abc",
+		"empty":    "::",
+	}
+	for name, token := range bad {
+		_, err = hmacs.Authenticate(credentials("token", token))
+		if err == nil {
+			t.Errorf("%s: expected an error for %s", name, token)
+		}
+	}
+}
+
+func TestAuthenticateConnection(t *testing.T) {
+	conf := NewServerConfig()
+	conf.Authenticator = &ApiKeyAuthenticator{Keys: map[string]string{"secret-key": "dustin"}}
+	conf.Register([]string{"GET"}, NewController("/whoami", []string{"GET"}, func(txn *Txn) {
+		response := NewResponse(txn)
+		response.Put("principal", txn.Principal.Id)
+		_, hasAuth := txn.Handshake.Hello.Get("auth")
+		response.Put("auth_visible", hasAuth)
+		txn.Write(response)
+	}))
+	connect := startUnixServer(t, conf, JsonListenUnix)
+
+	dial := func(key string) (net.Conn, Decoder) {
+		conn := connect()
+		//no features, so no hello is sent back
+		hello := dynmap.New()
+		hello.PutWithDot("auth.api_key", key)
+		JSON.WriteHello(conn, hello)
+		return conn, JSON.NewDecoder(conn)
+	}
+
+	conn, dec := dial("secret-key")
+	req := NewRequest("/whoami", "GET")
+	req.SetTxnId("1")
+	JSON.WriteRequest(req, conn)
+	res, err := dec.DecodeResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.MustString("principal", "") != "dustin" || res.MustBool("auth_visible", true) {
+		t.Errorf("Expected the principal without the credentials, got %v", res)
+	}
+
+	conn, dec = dial("wrong")
+	res, err = dec.DecodeResponse()
+	if err != nil || res.StatusCode() != UnauthorizedStatus {
+		t.Fatalf("Expected a 401, got %v %s", res, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = dec.DecodeResponse()
+	if err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %s", err)
+	}
+}
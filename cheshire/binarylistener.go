@@ -3,7 +3,7 @@ package cheshire
 
 import (
     "bufio"
-    "fmt"
+    "context"
     "log"
     "net"
     "sync"
@@ -16,33 +16,71 @@ type BinaryWriter struct {
     conn         net.Conn
     writer  *bufio.Writer
     writerLock   sync.Mutex
+    //set from the hello, defaults to BIN
+    protocol     *BinProtocol
 }
 
 func (this *BinaryWriter) Write(response *Response) (int, error) {
     defer this.writerLock.Unlock()
     this.writerLock.Lock()
     // log.Printf("Write response %s", response)
-    bytes, err := BIN.WriteResponse(response, this.writer)
+    protocol := this.protocol
+    if protocol == nil {
+        protocol = BIN
+    }
+    bytes, err := protocol.WriteResponse(response, this.writer)
     this.writer.Flush()
     return bytes, err
 }
 
+func (this *BinaryWriter) writeHeartbeat() error {
+    defer this.writerLock.Unlock()
+    this.writerLock.Lock()
+    err := this.protocol.WriteHeartbeat(this.writer)
+    if err != nil {
+        return err
+    }
+    return this.writer.Flush()
+}
+
 func (this *BinaryWriter) Type() string {
     return BIN.Type()
 }
 
 func BinaryListen(port int, config *ServerConfig) error {
-    ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-    defer ln.Close()
+    ln, err := listen(port, config)
     if err != nil {
         // handle error
         log.Println(err)
         return err
     }
     log.Println("Binary Listener on port: ", port)
+    return binaryServe(ln, config)
+}
+
+// Listens for binary strest connections on a unix socket
+func BinaryListenUnix(path string, config *ServerConfig) error {
+    ln, err := listenUnix(path)
+    if err != nil {
+        log.Println(err)
+        return err
+    }
+    log.Println("Binary Listener on socket: ", path)
+    return binaryServe(ln, config)
+}
+
+// accepts binary connections until the server is stopped
+func binaryServe(ln net.Listener, config *ServerConfig) error {
+    defer ln.Close()
+    if !config.lifecycle.addListener(ln) {
+        return nil
+    }
     for {
         conn, err := ln.Accept()
         if err != nil {
+            if config.lifecycle.stopping() {
+                return nil
+            }
             log.Print(err)
             // handle error
             continue
@@ -62,13 +100,39 @@ func BinaryListen(port int, config *ServerConfig) error {
 func handleConnection(conn *BinaryWriter) {
     defer conn.conn.Close()
     // log.Print("CONNECT!")
+    if !conn.serverConfig.lifecycle.addConn(conn.conn) {
+        return
+    }
+    defer conn.serverConfig.lifecycle.removeConn(conn.conn)
 
-    decoder := BIN.NewDecoder(bufio.NewReader(conn.conn))
-    _, err := decoder.DecodeHello()
+    //cancelled on disconnect so in flight txns can stop
+    ctx, cancel := context.WithCancel(conn.serverConfig.Context())
+    defer cancel()
+    state := newConnState(conn.serverConfig)
+
+    decoder := BIN.NewDecoder(bufio.NewReader(&IdleReader{Conn: conn.conn, Timeout: conn.serverConfig.IdleTimeout}))
+    decoder.SetLimits(conn.serverConfig.Limits)
+    hello, err := decoder.DecodeHello()
+    if err != nil {
+        log.Print(err)
+        writeLimitError(conn, err)
+        return
+    }
+    protocol := binProtocolForHello(hello)
+    conn.writerLock.Lock()
+    conn.protocol = protocol
+    err = state.greet(hello, protocol, conn.writer, conn.serverConfig)
+    //flushed even on error, so a rejected client gets the 401
+    flushErr := conn.writer.Flush()
+    if err == nil {
+        err = flushErr
+    }
+    conn.writerLock.Unlock()
     if err != nil {
         log.Print(err)
         return
     }
+    go sendHeartbeats(ctx, conn, protocol.Heartbeat)
     for {
         req, err := decoder.DecodeRequest()
         if err == io.EOF {
@@ -76,12 +140,12 @@ func handleConnection(conn *BinaryWriter) {
             break
         } else if err != nil {
             log.Print(err)
+            writeLimitError(conn, err)
             break
         }
         // log.Printf("GOT REQUEST %s", req)
         // //request
-        controller := conn.serverConfig.Router.Match(req.Method(), req.Uri())
-        go HandleRequest(req, conn, controller, conn.serverConfig)
+        dispatch(ctx, state, req, conn, conn.serverConfig)
     }
 
     log.Print("DISCONNECT!")
@@ -1,10 +1,13 @@
 package cheshire
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"reflect"
 	"runtime"
 	"strings"
+	"time"
 )
 
 type Bootstrap struct {
@@ -39,6 +42,65 @@ func (this *Bootstrap) InitProcs() {
 	}
 }
 
+// Sets the default request timeout from the request_timeout setting, (i.e. 30s)
+func (this *Bootstrap) InitRequestTimeout() {
+	if this.Conf.Exists("request_timeout") {
+		str, _ := this.Conf.GetString("request_timeout")
+		timeout, err := time.ParseDuration(str)
+		if err != nil {
+			log.Println("Error initing request timeout: ", err)
+			return
+		}
+		this.Conf.RequestTimeout = timeout
+	}
+}
+
+// Sets the strest connection idle timeout from the idle_timeout setting, (i.e. 2m)
+func (this *Bootstrap) InitIdleTimeout() {
+	if this.Conf.Exists("idle_timeout") {
+		str, _ := this.Conf.GetString("idle_timeout")
+		timeout, err := time.ParseDuration(str)
+		if err != nil {
+			log.Println("Error initing idle timeout: ", err)
+			return
+		}
+		this.Conf.IdleTimeout = timeout
+	}
+}
+
+// Sets the in flight limits from the inflight settings
+func (this *Bootstrap) InitInFlight() {
+	this.Conf.MaxInFlight = this.Conf.MustInt("inflight.max", this.Conf.MaxInFlight)
+	this.Conf.MaxInFlightPerConn = this.Conf.MustInt("inflight.max_per_connection", this.Conf.MaxInFlightPerConn)
+	this.Conf.RejectWhenBusy = this.Conf.MustBool("inflight.reject", this.Conf.RejectWhenBusy)
+	this.Conf.MaxQueuedPerConn = this.Conf.MustInt("inflight.max_queued_per_connection", this.Conf.MaxQueuedPerConn)
+}
+
+// Sets the packet size limits (in bytes) from the limits settings
+func (this *Bootstrap) InitLimits() {
+	this.Conf.Limits.MaxFrameSize = this.Conf.MustInt64("limits.max_frame_size", this.Conf.Limits.MaxFrameSize)
+	this.Conf.Limits.MaxParamsSize = this.Conf.MustInt64("limits.max_params_size", this.Conf.Limits.MaxParamsSize)
+	this.Conf.Limits.MaxContentSize = this.Conf.MustInt64("limits.max_content_size", this.Conf.Limits.MaxContentSize)
+}
+
+// Enables tls on all the listeners if tls.cert and tls.key are configured.
+// tls.client_ca enables client certificate verification
+func (this *Bootstrap) InitTLS() {
+	if !this.Conf.Exists("tls.cert") {
+		return
+	}
+	conf, err := NewTLSConfig(
+		this.Conf.MustString("tls.cert", ""),
+		this.Conf.MustString("tls.key", ""),
+		this.Conf.MustString("tls.client_ca", ""),
+	)
+	if err != nil {
+		//never fall back to plaintext
+		panic(fmt.Sprintf("Error initing tls: %s", err))
+	}
+	this.Conf.TLS = conf
+}
+
 //this needs to be setup correctly to key off of the config yaml
 func (this *Bootstrap) InitStaticFiles() {
 	if this.Conf.Exists("http.static_files.route") {
@@ -67,6 +129,18 @@ func (this *Bootstrap) InitWebSockets() {
 
 }
 
+// Registers the route introspection controller if
+// introspection.route is configured (typically /_routes)
+func (this *Bootstrap) InitIntrospection() {
+	if this.Conf.Exists("introspection.route") {
+		route, ok := this.Conf.GetString("introspection.route")
+		if ok {
+			m := []string{"GET"}
+			this.Conf.Register(m, NewController(route, m, RoutesController))
+		}
+	}
+}
+
 func (this *Bootstrap) InitControllers() {
 	//We put the ping controller in by default.
 	
@@ -103,21 +177,25 @@ type controllerWrapper struct {
 }
 
 // Registers a controller funtion for api calls 
-func RegisterApi(route string, method string, handler func(*Txn), filters ...ControllerFilter) {
+// returns the controller config so the route can be named, see ControllerConfig.Named
+func RegisterApi(route string, method string, handler func(*Txn), filters ...ControllerFilter) *ControllerConfig {
 	m := strings.ToUpper(method)
 
 	controller := NewController(route, []string{m}, handler)
 	controller.Config().Filters = filters
 	Register([]string{m}, controller)
+	return controller.Config()
 }
 
 // Registers a controller function for html pages  
-func RegisterHtml(route string, method string, handler func(*Txn), filters ...ControllerFilter) {
+// returns the controller config so the route can be named, see ControllerConfig.Named
+func RegisterHtml(route string, method string, handler func(*Txn), filters ...ControllerFilter) *ControllerConfig {
 	m := strings.ToUpper(method)
 
 	controller := NewHtmlController(route, []string{m}, handler)
 	controller.Config().Filters = filters
 	Register([]string{m}, controller)
+	return controller.Config()
 }
 
 // Registers a new controller
@@ -153,41 +231,90 @@ func NewExtendedBootstrap(configPath string, extentions []func(conf *ServerConfi
 }
 
 //starts listening in all the configured listeners
-//this method does not return until all listeners exit (i.e. never).
-func (this *Bootstrap) Start() {
+//this method does not return until all listeners exit, either
+//because Stop was called or a listener failed (i.e. the port is in use).
+//returns the first listener error.
+func (this *Bootstrap) Start() error {
 	this.RunInitMethods(this)
 	log.Println("********** Starting Cheshire **************")
+
+	//the listener for each ports.* key
+	listeners := []struct {
+		name     string
+		listener func(int, *ServerConfig) error
+	}{
+		{"http", HttpListen},
+		{"json", JsonListen},
+		{"bin", BinaryListen},
+		{"multi", MultiListen},
+	}
+
+	//the listener for each sockets.* key
+	sockets := []struct {
+		name     string
+		listener func(string, *ServerConfig) error
+	}{
+		{"json", JsonListenUnix},
+		{"bin", BinaryListenUnix},
+	}
+
+	errs := make(chan error, len(listeners)+len(sockets))
+	count := 0
 	//now start listening.
-	if this.Conf.Exists("ports.http") {
-		port, ok := this.Conf.GetInt("ports.http")
+	for _, l := range listeners {
+		key := fmt.Sprintf("ports.%s", l.name)
+		if !this.Conf.Exists(key) {
+			continue
+		}
+		count++
+		port, ok := this.Conf.GetInt(key)
 		if !ok {
-			log.Println("ERROR: Couldn't start http listener ", port)
-		} else {
-			go HttpListen(port, this.Conf)
+			errs <- fmt.Errorf("Couldn't start %s listener, bad port", l.name)
+			continue
 		}
+		go func(listener func(int, *ServerConfig) error, port int) {
+			errs <- listener(port, this.Conf)
+		}(l.listener, port)
 	}
-
-	if this.Conf.Exists("ports.json") {
-		port, ok := this.Conf.GetInt("ports.json")
-		if !ok {
-			log.Println("ERROR: Couldn't start json listener")
-		} else {
-			go JsonListen(port, this.Conf)
+	for _, s := range sockets {
+		key := fmt.Sprintf("sockets.%s", s.name)
+		if !this.Conf.Exists(key) {
+			continue
 		}
+		count++
+		path, ok := this.Conf.GetString(key)
+		if !ok || path == "" {
+			errs <- fmt.Errorf("Couldn't start %s socket listener, bad path", s.name)
+			continue
+		}
+		go func(listener func(string, *ServerConfig) error, path string) {
+			errs <- listener(path, this.Conf)
+		}(s.listener, path)
 	}
 
-	if this.Conf.Exists("ports.bin") {
-		port, ok := this.Conf.GetInt("ports.bin")
-		if !ok {
-			log.Println("ERROR: Couldn't start binary listener")
-		} else {
-			go BinaryListen(port, this.Conf)
-		}	
+	var err error
+	for i := 0; i < count; i++ {
+		e := <-errs
+		if e != nil && err == nil {
+			log.Println("ERROR: ", e)
+			err = e
+			//shut down the other listeners
+			go this.Stop(context.Background())
+		}
 	}
+	return err
+}
+
+// Gracefully stops all the listeners.
+// see ServerConfig.Shutdown
+func (this *Bootstrap) Stop(ctx context.Context) error {
+	return this.Conf.Shutdown(ctx)
+}
 
-	//this just makes the current thread sleep.  kinda stupid currently.
-	//but we should update to get messages from the listeners, like when a listener quites
-	channel := make(chan string)
-	val := <-channel
-	log.Println(val)
+// Stops the server, waiting DefaultShutdownTimeout for in flight txns.
+// Implements io.Closer so the bootstrap can be registered with the closer package.
+func (this *Bootstrap) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	return this.Stop(ctx)
 }
@@ -0,0 +1,70 @@
+package cheshire
+
+import (
+	"context"
+	"sync"
+)
+
+// The reserved method for a txn cancel request.
+// A cancel request carries the id of the txn to cancel, the uri and params
+// are ignored.  The txn context is cancelled and a final completed
+// response is sent on the txn.
+const CANCEL = "CANCEL"
+
+// The status code of the completed response sent when a txn is cancelled
+const CancelledStatus = 499
+
+// The txns in flight on a single strest connection, so they can be
+// cancelled by id.
+type txnRegistry struct {
+	lock sync.Mutex
+	txns map[string]*Txn
+}
+
+func newTxnRegistry() *txnRegistry {
+	return &txnRegistry{
+		txns: make(map[string]*Txn),
+	}
+}
+
+// adds the txn, it is removed once its context is done
+func (this *txnRegistry) add(txn *Txn) {
+	id := txn.TxnId()
+	this.lock.Lock()
+	this.txns[id] = txn
+	this.lock.Unlock()
+	context.AfterFunc(txn.Context(), func() {
+		this.lock.Lock()
+		defer this.lock.Unlock()
+		//txn ids could be reused once completed
+		if this.txns[id] == txn {
+			delete(this.txns, id)
+		}
+	})
+}
+
+// cancels the txn with the id.
+// returns false if it is not in flight
+func (this *txnRegistry) cancel(txnId string) bool {
+	this.lock.Lock()
+	txn, ok := this.txns[txnId]
+	this.lock.Unlock()
+	if !ok {
+		return false
+	}
+	return txn.cancelTxn()
+}
+
+// Writes the final cancelled response, which cancels the txn context.
+// returns false if the txn was already done
+func (this *Txn) cancelTxn() bool {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+	if this.Context().Err() != nil {
+		return false
+	}
+	this.write(NewError(this, CancelledStatus, "Txn Cancelled"))
+	//make sure the handler stops even if the write failed
+	this.complete()
+	return true
+}
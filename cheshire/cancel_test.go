@@ -0,0 +1,67 @@
+package cheshire
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCancelTxn(t *testing.T) {
+	conf := NewServerConfig()
+	stopped := make(chan bool)
+	conf.Register([]string{"GET"}, NewController("/firehose", []string{"GET"}, func(txn *Txn) {
+		for txn.Context().Err() == nil {
+			response := NewResponse(txn)
+			response.SetTxnContinue()
+			txn.Write(response)
+			time.Sleep(time.Millisecond)
+		}
+		stopped <- true
+	}))
+
+	writer := &testWriter{}
+	state := newConnState(conf)
+	txns := state.txns
+	ctx := context.Background()
+	for _, id := range []string{"1", "2"} {
+		req := NewRequest("/firehose", "GET")
+		req.SetTxnId(id)
+		req.SetTxnAccept("multi")
+		dispatch(ctx, state, req, writer, conf)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	cancel := NewRequest("", CANCEL)
+	cancel.SetTxnId("1")
+	dispatch(ctx, state, cancel, writer, conf)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Handler context was not cancelled")
+	}
+
+	var final *Response
+	for _, response := range writer.written() {
+		if response.TxnId() != "1" {
+			continue
+		}
+		if final != nil {
+			t.Fatalf("Response written after the cancelled response")
+		}
+		if response.TxnComplete() {
+			final = response
+		}
+	}
+	if final == nil || final.StatusCode() != CancelledStatus {
+		t.Fatalf("Expected a final cancelled response, got %v", final)
+	}
+
+	//the other txn is unaffected
+	if txns.cancel("1") {
+		t.Errorf("Txn should no longer be in flight")
+	}
+	if !txns.cancel("2") {
+		t.Errorf("Expected the second txn to still be in flight")
+	}
+	<-stopped
+}
@@ -0,0 +1,158 @@
+package cheshire
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"github.com/trendrr/goshire/dynmap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Compression for strest connections is negotiated in the hello with the
+// "compression" key.  Once negotiated, packets larger then CompressionThreshold
+// are sent gzipped, smaller packets are sent as is.
+
+// The supported compression, the index is the binary frame flag
+var COMPRESSION = []string{
+	"none", //0
+	"gzip", //1
+}
+
+// Packets smaller then this are never compressed
+var CompressionThreshold = 4096
+
+// is the compression supported, none and empty are always supported
+func SupportedCompression(compression string) bool {
+	for _, c := range COMPRESSION {
+		if c == compression {
+			return true
+		}
+	}
+	return compression == ""
+}
+
+// the compression to use for a connection based on its hello
+func helloCompression(hello *dynmap.DynMap) string {
+	if hello == nil {
+		return ""
+	}
+	c := hello.MustString("compression", "")
+	if c == "none" || !SupportedCompression(c) {
+		return ""
+	}
+	return c
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	err = gz.Close()
+	return buf.Bytes(), err
+}
+
+// gunzips b, failing if it is larger then max (0 for no max)
+func gunzipBytes(b []byte, max int64) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	if max <= 0 {
+		return ioutil.ReadAll(gz)
+	}
+	packet, err := ioutil.ReadAll(io.LimitReader(gz, max+1))
+	if err == nil && int64(len(packet)) > max {
+		err = &LimitError{What: "frame", Max: max}
+	}
+	return packet, err
+}
+
+// Writes a binary packet on a framed (compressed or heartbeat) connection.
+// A flag byte (the COMPRESSION index) is followed by either the packet as is
+// or the int32 length and the gzipped packet.  A heartbeat is just the
+// flag, see binHeartbeatFrame.
+func writeBinFrame(writer io.Writer, packet []byte, compress bool) error {
+	if !compress || len(packet) < CompressionThreshold {
+		err := binary.Write(writer, binary.BigEndian, int8(0))
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(packet)
+		return err
+	}
+	gz, err := gzipBytes(packet)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(writer, binary.BigEndian, int8(1))
+	if err != nil {
+		return err
+	}
+	_, err = WriteByteArray32(writer, gz)
+	return err
+}
+
+// Reads the frame header on a framed connection, skipping heartbeats.
+// returns the reader to decode the packet from, limited to the max frame size.
+func readBinFrame(frame *frameReader) (io.Reader, error) {
+	flag := binHeartbeatFrame
+	for flag == binHeartbeatFrame {
+		err := binary.Read(frame.reader, binary.BigEndian, &flag)
+		if err != nil {
+			return nil, err
+		}
+	}
+	frame.reset()
+	switch flag {
+	case 0:
+		return frame, nil
+	case 1:
+		gz, err := readByteArray32Limited(frame, frame.max, "frame")
+		if err != nil {
+			return nil, err
+		}
+		packet, err := gunzipBytes(gz, frame.max)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(packet), nil
+	}
+	return nil, fmt.Errorf("Unsupported compression %d", flag)
+}
+
+// does the http client accept gzipped responses
+func acceptsGzip(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept-Encoding"), "gzip")
+}
+
+// Decides whether to gzip the http response, called before the header
+// is written. A single small response is not worth compressing, streams
+// and large responses are.
+func (this *HttpWriter) startGzip(response *Response, json []byte) {
+	header := this.Writer.Header()
+	header.Add("Vary", "Accept-Encoding")
+	if response.TxnComplete() && len(json) < CompressionThreshold {
+		return
+	}
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	this.gzip = gzip.NewWriter(this.Writer)
+}
+
+// no more writes after the handler returns, closes the gzip stream if there is one
+func (this *HttpWriter) finish() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.finished = true
+	if this.gzip != nil {
+		this.gzip.Close()
+	}
+}
@@ -0,0 +1,140 @@
+package cheshire
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/trendrr/goshire/dynmap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// a small and a large (compressed) response for the txn
+func compressionResponses() []*Response {
+	req := NewRequest("/test", "GET")
+	req.SetTxnId("5")
+	txn := NewTxn(req, nil, nil, NewServerConfig())
+	small := NewResponse(txn)
+	small.Put("value", "small")
+	large := NewResponse(txn)
+	large.Put("value", strings.Repeat("large", CompressionThreshold))
+	return []*Response{small, large}
+}
+
+func TestCompressedProtocols(t *testing.T) {
+	protocols := map[string]Protocol{
+		"json": &JSONProtocol{Compression: "gzip"},
+		"bin":  &BinProtocol{ParamEncoding: "json", Compression: "gzip"},
+	}
+	for name, protocol := range protocols {
+		var buf bytes.Buffer
+		err := protocol.WriteHello(&buf, dynmap.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses := compressionResponses()
+		for _, response := range responses {
+			_, err = protocol.WriteResponse(response, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if buf.Len() > CompressionThreshold*2 {
+			t.Errorf("%s: expected the large response to be compressed, wrote %d bytes", name, buf.Len())
+		}
+
+		//the server decodes with the default protocol, the hello turns on compression
+		dec := JSON.NewDecoder(&buf)
+		if name == "bin" {
+			dec = BIN.NewDecoder(&buf)
+		}
+		hello, err := dec.DecodeHello()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if helloCompression(hello) != "gzip" {
+			t.Errorf("%s: expected gzip in the hello %v", name, hello)
+		}
+		for _, response := range responses {
+			decoded, err := dec.DecodeResponse()
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if decoded.MustString("value", "") != response.MustString("value", "") || decoded.TxnId() != "5" {
+				t.Errorf("%s: round trip failed %v", name, decoded)
+			}
+		}
+	}
+}
+
+func TestJsonDecodeHelloOptional(t *testing.T) {
+	var buf bytes.Buffer
+	req := NewRequest("/test", "GET")
+	req.SetTxnId("1")
+	JSON.WriteHello(&buf, dynmap.New())
+	JSON.WriteRequest(req, &buf)
+	//older servers don't expect a hello, so an empty one isn't sent
+	if strings.Contains(buf.String(), "hello") {
+		t.Errorf("Unexpected hello packet %s", buf.String())
+	}
+
+	dec := JSON.NewDecoder(&buf)
+	hello, err := dec.DecodeHello()
+	if err != nil || len(hello.Map) != 0 {
+		t.Errorf("Expected an empty hello, got %v %s", hello, err)
+	}
+	decoded, err := dec.DecodeRequest()
+	if err != nil || decoded.Uri() != "/test" {
+		t.Errorf("Expected the first request after the hello, got %v %s", decoded, err)
+	}
+}
+
+func TestHttpGzip(t *testing.T) {
+	conf := NewServerConfig()
+	conf.Register([]string{"GET"}, NewController("/small", []string{"GET"}, func(txn *Txn) {
+		txn.Write(compressionResponses()[0])
+	}))
+	conf.Register([]string{"GET"}, NewController("/large", []string{"GET"}, func(txn *Txn) {
+		txn.Write(compressionResponses()[1])
+	}))
+	server := httptest.NewServer(&httpHandler{conf})
+	defer server.Close()
+
+	get := func(uri, acceptEncoding string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", server.URL+uri, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	res, body := get("/large", "gzip, deflate")
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a gzipped response, got %v", res.Header)
+	}
+	gz, err := gzip.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unzipped, err := ioutil.ReadAll(gz)
+	if err != nil || !strings.Contains(string(unzipped), "largelarge") {
+		t.Errorf("Bad gzipped body %s", err)
+	}
+
+	res, body = get("/small", "gzip")
+	if res.Header.Get("Content-Encoding") != "" || !strings.Contains(body, "small") {
+		t.Errorf("Expected a small response as is, got %v %s", res.Header, body)
+	}
+	res, body = get("/large", "")
+	if res.Header.Get("Content-Encoding") != "" || !strings.Contains(body, "largelarge") {
+		t.Errorf("Expected no compression without the accept header")
+	}
+}
@@ -1,27 +1,92 @@
 package cheshire
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/kylelemons/go-gypsy/yaml"
 	"github.com/trendrr/goshire/dynmap"
 	"log"
+	"sync"
+	"time"
 )
 
 type ServerConfig struct {
 	*dynmap.DynMap
 	Router  RouteMatcher
 	Filters []ControllerFilter
+
+	//The default time controllers have to complete a txn, 0 for no timeout.
+	//see ControllerConfig.Timeout
+	RequestTimeout time.Duration
+
+	//Optional hook called when a controller or filter panics, i.e. to forward to alerting.
+	//The panic is always logged and a 500 is sent to the client.
+	PanicHandler func(txn *Txn, err interface{}, stack []byte)
+
+	//Max txns in flight on a single json, binary or websocket connection. 0 for unlimited
+	MaxInFlightPerConn int
+	//Max txns in flight across all json, binary and websocket connections. 0 for unlimited
+	MaxInFlight int
+	//When an in flight limit is reached, reply with a 503 rather then
+	//queueing the txn until there is room (see MaxQueuedPerConn)
+	RejectWhenBusy bool
+	//When not rejecting, the txns that can wait for an in flight slot on a single
+	//connection.  Once these are waiting the connection stops being read until
+	//there is room, pushing back on the client.  0 stops reading as soon as a txn waits
+	MaxQueuedPerConn int
+
+	//Json, binary and websocket connections that send nothing, not even a heartbeat,
+	//for this long are closed. 0 for no timeout.
+	//clients heartbeats must be more frequent then this.
+	IdleTimeout time.Duration
+
+	//Authenticates json, binary and websocket connections from the credentials
+	//in their hello.  Connections that fail are sent a 401 and closed.
+	//nil accepts every connection
+	Authenticator ConnectionAuthenticator
+
+	//The largest packets json, binary and websocket connections may send.
+	//defaults to DefaultLimits
+	Limits Limits
+
+	//When set the http, json and binary listeners all use tls.
+	//see NewTLSConfig
+	TLS *tls.Config
+
+	inflight     chan bool
+	inflightOnce sync.Once
+
+	//cancelled when the server shuts down
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	//listeners, connections and txns, for clean shutdown
+	lifecycle lifecycle
 }
 
 // Creates a new server config with a default routematcher
 func NewServerConfig() *ServerConfig {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &ServerConfig{
-		dynmap.NewDynMap(),
-		NewDefaultRouter(),
-		make([]ControllerFilter, 0),
+		DynMap:  dynmap.NewDynMap(),
+		Router:  NewDefaultRouter(),
+		Filters: make([]ControllerFilter, 0),
+		Limits:  DefaultLimits,
+		ctx:     ctx,
+		cancel:  cancel,
 	}
 }
 
+// The server wide context, this is cancelled when the server shuts down.
+// All txn contexts are children of this.
+func (this *ServerConfig) Context() context.Context {
+	if this.ctx == nil {
+		return context.Background()
+	}
+	return this.ctx
+}
+
 // Registers a controller with the RouteMatcher.  
 // shortcut to conf.Router.Register(controller)
 func (this *ServerConfig) Register(methods []string, controller Controller) {
@@ -30,6 +95,21 @@ func (this *ServerConfig) Register(methods []string, controller Controller) {
 }
 
 
+// the server wide in flight slots, nil if unlimited
+func (this *ServerConfig) globalInflight() chan bool {
+	this.inflightOnce.Do(func() {
+		if this.MaxInFlight > 0 {
+			this.inflight = make(chan bool, this.MaxInFlight)
+		}
+	})
+	return this.inflight
+}
+
+// Builds the url for the named route, see RouteURL
+func (this *ServerConfig) URL(name string, params *dynmap.DynMap) (string, error) {
+	return RouteURL(this.Router, name, params)
+}
+
 // Parses a server config from a YAML file
 func NewServerConfigFile(path string) *ServerConfig {
 	conf, err := yaml.ReadFile(path)
@@ -0,0 +1,141 @@
+package cheshire
+
+import (
+	"fmt"
+	"io"
+)
+
+// The size of the content chunks sent by SendContentStream
+var ContentChunkSize = 64 * 1024
+
+// Streams large content (i.e. a file download or export) from the reader
+// without holding it all in memory.
+//
+// On binary connections (including binary websockets) each chunk is sent as
+// a continue response with the chunk as its content, followed by an empty
+// completed response.  The request should accept multi.
+// On http connections the content is written as the response body, event
+// streams can only carry events so get a 400.
+//
+// The txn is always completed, if the reader fails a 500 is sent
+// (or the http body is cut short).  Other connection types get a 400.
+func SendContentStream(txn *Txn, contentEncoding string, reader io.Reader) error {
+	if _, ok := BINCONST.ContentEncoding[contentEncoding]; !ok {
+		SendError(txn, 500, "Bad content encoding")
+		return fmt.Errorf("Bad content encoding %s", contentEncoding)
+	}
+	if txn.Type() == "http" || txn.Type() == "html" {
+		return sendHttpContentStream(txn, reader)
+	}
+	if !carriesContent(txn) {
+		SendError(txn, 400, "Content streams require a binary connection")
+		return fmt.Errorf("Content streams are not supported on %s connections", txn.Type())
+	}
+
+	for {
+		//a new buffer per chunk, writers and filters may hold on to the response
+		buf := make([]byte, ContentChunkSize)
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			chunk := NewResponse(txn)
+			chunk.SetTxnContinue()
+			chunk.SetContent(contentEncoding, buf[:n])
+			_, werr := txn.Write(chunk)
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			_, err = txn.Write(NewResponse(txn))
+			return err
+		}
+		if err != nil {
+			SendError(txn, 500, "Error reading content")
+			return err
+		}
+	}
+}
+
+// can content be sent on the txns connection
+func carriesContent(txn *Txn) bool {
+	if txn.Type() == BIN.Type() {
+		return true
+	}
+	ws, ok := txn.Writer.(*WebsocketWriter)
+	return ok && ws.protocol.Type() == BIN.Type()
+}
+
+// writes the content as the http body, flushing each chunk.
+// event streams can only carry events, so content streams are refused
+func sendHttpContentStream(txn *Txn, reader io.Reader) error {
+	writer, err := ToHttpWriter(txn)
+	if err != nil {
+		return err
+	}
+	if writer.EventStream {
+		SendError(txn, 400, "Content streams are not supported on event streams")
+		return fmt.Errorf("Content streams are not supported on event streams")
+	}
+	defer txn.finish()
+	if !beforeWrite(txn, writer) {
+		return nil
+	}
+	buf := make([]byte, ContentChunkSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			werr := writeHttpChunk(txn, writer, buf[:n])
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writes a chunk of the body under the txn write lock,
+// so it can't interleave with a 504 or cancel
+func writeHttpChunk(txn *Txn, writer *HttpWriter, chunk []byte) error {
+	txn.writeLock.Lock()
+	defer txn.writeLock.Unlock()
+	if err := txn.Context().Err(); err != nil {
+		return err
+	}
+	//the body has started, it can take as long as it needs
+	txn.stopDeadline()
+	return writer.writeBody(chunk)
+}
+
+// writes raw bytes to the http body, the first write sends a 200
+func (this *HttpWriter) writeBody(b []byte) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.finished {
+		return fmt.Errorf("Http response finished")
+	}
+	this.headerWritten.Do(func() {
+		this.Writer.Header().Set("Content-Type", "application/octet-stream")
+		this.Writer.WriteHeader(200)
+	})
+	var writer io.Writer = this.Writer
+	if this.gzip != nil {
+		writer = this.gzip
+	}
+	_, err := writer.Write(b)
+	if err != nil {
+		return err
+	}
+	if this.gzip != nil {
+		err = this.gzip.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	this.flush()
+	return nil
+}
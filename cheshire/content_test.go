@@ -0,0 +1,106 @@
+package cheshire
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pauses before each read
+type slowReader struct {
+	reader *bytes.Reader
+	pause  time.Duration
+}
+
+func (this *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(this.pause)
+	return this.reader.Read(p)
+}
+
+func TestSendContentStreamHttp(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), ContentChunkSize/4)
+	conf := NewServerConfig()
+	conf.Register([]string{"GET"}, NewController("/download", []string{"GET"}, func(txn *Txn) {
+		err := SendContentStream(txn, "bytes", bytes.NewReader(content))
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	server := httptest.NewServer(&httpHandler{conf})
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.Header.Get("Content-Type") != "application/octet-stream" || !bytes.Equal(body, content) {
+		t.Errorf("Expected the content as the body, got %d bytes", len(body))
+	}
+}
+
+func TestSendContentStreamUnsupported(t *testing.T) {
+	writer := &testWriter{}
+	txn := NewTxn(NewRequest("/download", "GET"), writer, nil, NewServerConfig())
+	err := SendContentStream(txn, "bytes", bytes.NewReader([]byte("content")))
+	written := writer.written()
+	if err == nil || len(written) != 1 || written[0].StatusCode() != 400 {
+		t.Errorf("Expected a 400 on a connection that can't carry content, got %v", written)
+	}
+}
+
+func TestSendContentStreamHttpDeadline(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), ContentChunkSize/4)
+	conf := NewServerConfig()
+	controller := NewController("/download", []string{"GET"}, func(txn *Txn) {
+		SendContentStream(txn, "bytes", &slowReader{bytes.NewReader(content), 20 * time.Millisecond})
+	})
+	controller.Config().Timeout = 30 * time.Millisecond
+	conf.Register([]string{"GET"}, controller)
+	server := httptest.NewServer(&httpHandler{conf})
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 || !bytes.Equal(body, content) {
+		t.Errorf("Expected the whole content past the deadline, got %d %d bytes", res.StatusCode, len(body))
+	}
+}
+
+func TestSendContentStreamEventStream(t *testing.T) {
+	conf := NewServerConfig()
+	conf.Register([]string{"GET"}, NewController("/download", []string{"GET"}, func(txn *Txn) {
+		err := SendContentStream(txn, "bytes", bytes.NewReader([]byte("content")))
+		if err == nil {
+			t.Errorf("Expected content streams to be refused on event streams")
+		}
+	}))
+	server := httptest.NewServer(&httpHandler{conf})
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/download", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	for _, line := range strings.Split(string(body), "\n") {
+		if line != "" && !strings.HasPrefix(line, "id: ") && !strings.HasPrefix(line, "data: ") {
+			t.Errorf("Expected only events, got %q", line)
+		}
+	}
+	if !strings.Contains(string(body), "400") {
+		t.Errorf("Expected a 400 event, got %s", body)
+	}
+}
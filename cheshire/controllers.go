@@ -1,7 +1,12 @@
 package cheshire
 
 import (
+    "context"
     "github.com/trendrr/goshire/dynmap"
+    "log"
+    "runtime/debug"
+    "sync"
+    "time"
 )
 
 
@@ -40,6 +45,29 @@ type Txn struct {
 
     //the immutable server config
     ServerConfig *ServerConfig
+
+    //The hello negotiated on json, binary and websocket connections
+    //(the clients user agent and features).  nil for http
+    Handshake *Handshake
+
+    //The client authenticated in the hello, see ServerConfig.Authenticator.
+    //nil for http or when there is no authenticator
+    Principal *Principal
+
+    //cancelled when the connection closes, the server shuts down
+    //or a completed response is written
+    ctx    context.Context
+    cancel context.CancelFunc
+
+    //serializes writes so nothing is written after the txn completes
+    writeLock sync.Mutex
+    //sends a 504 if the txn does not complete in time
+    deadline *time.Timer
+
+    //called once the txn is no longer in flight, see onRelease
+    releaseLock sync.Mutex
+    released    bool
+    releasers   []func()
 }
 
 func (this *Txn) Params() *dynmap.DynMap {
@@ -50,8 +78,29 @@ func (this *Txn) TxnId() string {
     return this.Request.TxnId()
 }
 
+// The context for this txn.
+// It is cancelled when the underlying connection closes, when the server
+// shuts down or once a completed response has been written.
+// Long running and streaming controllers should stop when it is done.
+func (this *Txn) Context() context.Context {
+    if this.ctx == nil {
+        return context.Background()
+    }
+    return this.ctx
+}
+
 // Writes a response to the underlying writer.
+// Returns the context error without writing if the txn context is done.
 func (this *Txn) Write(response *Response) (int, error) {
+    this.writeLock.Lock()
+    defer this.writeLock.Unlock()
+    return this.write(response)
+}
+
+func (this *Txn) write(response *Response) (int, error) {
+    if err := this.Context().Err(); err != nil {
+        return 0, err
+    }
 
     //Call the filters.
     for _, filter := range this.Filters {
@@ -69,9 +118,90 @@ func (this *Txn) Write(response *Response) (int, error) {
             f.AfterWrite(response, this)
         }
     }
+    if response.TxnComplete() {
+        this.complete()
+    } else {
+        //a stream has started, it can run for as long as the client wants
+        this.stopDeadline()
+    }
     return c, err
 }
 
+// completes the txn after writing outside of Write, i.e. an html body
+func (this *Txn) finish() {
+    this.writeLock.Lock()
+    defer this.writeLock.Unlock()
+    this.complete()
+}
+
+// marks the txn as finished, stops the deadline and cancels the context.
+// must hold the writeLock
+func (this *Txn) complete() {
+    this.stopDeadline()
+    if this.cancel != nil {
+        this.cancel()
+    }
+}
+
+// Calls f once the txn is no longer in flight, when its context is done or,
+// for single txns, when the handler returns (handlers and filters may return
+// without writing a completed response).  i.e. frees the in flight slot
+func (this *Txn) onRelease(f func()) {
+    this.releaseLock.Lock()
+    if !this.released {
+        this.releasers = append(this.releasers, f)
+        this.releaseLock.Unlock()
+        return
+    }
+    this.releaseLock.Unlock()
+    f()
+}
+
+func (this *Txn) release() {
+    this.releaseLock.Lock()
+    if this.released {
+        this.releaseLock.Unlock()
+        return
+    }
+    this.released = true
+    releasers := this.releasers
+    this.releasers = nil
+    this.releaseLock.Unlock()
+    for _, f := range releasers {
+        f()
+    }
+}
+
+// does the client accept more then one response
+func (this *Txn) streaming() bool {
+    return this.Request.TxnAccept() == "multi"
+}
+
+// Starts the txn deadline. If neither a completed response nor the first
+// response of a stream has been written before the timeout a 504 is sent
+// and the txn is cancelled.
+func (this *Txn) setDeadline(timeout time.Duration) {
+    this.writeLock.Lock()
+    defer this.writeLock.Unlock()
+    this.deadline = time.AfterFunc(timeout, func() {
+        this.writeLock.Lock()
+        defer this.writeLock.Unlock()
+        if this.deadline == nil || this.Context().Err() != nil {
+            //already responded, complete or disconnected
+            return
+        }
+        this.write(NewError(this, 504, "Gateway Timeout"))
+    })
+}
+
+// must hold the writeLock
+func (this *Txn) stopDeadline() {
+    if this.deadline != nil {
+        this.deadline.Stop()
+        this.deadline = nil
+    }
+}
+
 //Returns the connection type.
 //currently will be one of http,html,json,websocket
 func (this *Txn) Type() string {
@@ -79,19 +209,56 @@ func (this *Txn) Type() string {
 }
 
 func NewTxn(request *Request, writer Writer, filters []ControllerFilter, serverConfig *ServerConfig) *Txn {
-    return &Txn{
+    return NewTxnContext(serverConfig.Context(), request, writer, filters, serverConfig)
+}
+
+// Creates a new txn whose context is a child of the passed in context
+func NewTxnContext(ctx context.Context, request *Request, writer Writer, filters []ControllerFilter, serverConfig *ServerConfig) *Txn {
+    ctx, cancel := context.WithCancel(ctx)
+    txn := &Txn{
         Request:      request,
         Writer:       writer,
         Session:      dynmap.NewDynMap(),
         Filters:      filters,
         ServerConfig: serverConfig,
+        ctx:          ctx,
+        cancel:       cancel,
     }
+    context.AfterFunc(ctx, txn.release)
+    return txn
 }
 
 // Configuration for a specific controller.
 type ControllerConfig struct {
     Route   string
     Filters []ControllerFilter
+    // Optional name for the route, used to build urls via RouteURL.
+    // Once the controller is registered use Named to change it.
+    Name string
+    // How long the controller has to write a completed response, or start a
+    // stream, before a 504 is sent.  0 uses the ServerConfig.RequestTimeout,
+    // negative disables the timeout.
+    Timeout time.Duration
+    // Always send responses to http requests as server sent events,
+    // otherwise only when the client accepts text/event-stream
+    EventStream bool
+
+    //the route and filters before a RouteGroup added its prefix and filters
+    ungrouped *ControllerConfig
+    //the name index of the router this was registered with
+    names *routeNames
+}
+
+// Sets the name of the route, updating the routers
+// name index if the controller is already registered.
+// returns the config so calls can be chained
+func (this *ControllerConfig) Named(name string) *ControllerConfig {
+    old := this.Name
+    this.Name = name
+    if this.names != nil {
+        this.names.rename(this, old)
+    }
+    return this
 }
 
 func NewControllerConfig(route string) *ControllerConfig {
@@ -104,18 +271,58 @@ func NewControllerConfig(route string) *ControllerConfig {
 
 // Implements the handle request, does the full filter stack.
 func HandleRequest(request *Request, conn Writer, controller Controller, serverConfig *ServerConfig) {
+    HandleRequestContext(serverConfig.Context(), request, conn, controller, serverConfig)
+}
+
+// Same as HandleRequest, the txn context will be a child of ctx.
+// Listeners should pass a context that is cancelled when the connection closes.
+func HandleRequestContext(ctx context.Context, request *Request, conn Writer, controller Controller, serverConfig *ServerConfig) {
+    handleRequest(ctx, request, conn, controller, serverConfig, nil)
+}
+
+// handles the request, done is called (if not nil) once the txn is no longer in flight
+func handleRequest(ctx context.Context, request *Request, conn Writer, controller Controller, serverConfig *ServerConfig, done func()) {
+    txn := newControllerTxn(ctx, request, conn, controller, serverConfig)
+    if done != nil {
+        txn.onRelease(done)
+    }
+    serveTxn(txn, controller)
+}
 
+// wraps the writer in a Txn with the server and controller filters
+func newControllerTxn(ctx context.Context, request *Request, conn Writer, controller Controller, serverConfig *ServerConfig) *Txn {
     //slice of all the filters
     filters := append(make([]ControllerFilter, 0), serverConfig.Filters...)
     if controller.Config() != nil {
         filters = append(filters, controller.Config().Filters...)
     }
+    return NewTxnContext(ctx, request, conn, filters, serverConfig)
+}
 
-    //wrap the writer in a Txn
-    txn := NewTxn(request, conn, filters, serverConfig)
+// runs the filters and the controller for the txn
+func serveTxn(txn *Txn, controller Controller) {
+    serverConfig := txn.ServerConfig
+    if !serverConfig.lifecycle.addTxn(txn) {
+        SendError(txn, 503, "Server shutting down")
+        return
+    }
+
+    timeout := serverConfig.RequestTimeout
+    if controller.Config() != nil && controller.Config().Timeout != 0 {
+        timeout = controller.Config().Timeout
+    }
+    if timeout > 0 {
+        txn.setDeadline(timeout)
+    }
+
+    //single txns are done once the handler returns, streams once completed
+    if !txn.streaming() {
+        defer txn.release()
+    }
+    defer recoverPanic(txn)
 
     //controller Before filters
-    for _, f := range filters {
+    for _, f := range txn.Filters {
         ok := f.Before(txn)
         if !ok {
             return
@@ -124,6 +331,22 @@ func HandleRequest(request *Request, conn Writer, controller Controller, serverC
     controller.HandleRequest(txn)
 }
 
+// Recovers from a panic in the filters or controller.
+// Logs the stack, calls the ServerConfig.PanicHandler if set
+// and sends a 500 so the connection stays usable.
+func recoverPanic(txn *Txn) {
+    r := recover()
+    if r == nil {
+        return
+    }
+    stack := debug.Stack()
+    log.Printf("PANIC in txn %s (%s): %v\n%s", txn.TxnId(), txn.Request.Uri(), r, stack)
+    if txn.ServerConfig.PanicHandler != nil {
+        txn.ServerConfig.PanicHandler(txn, r, stack)
+    }
+    SendError(txn, 500, "Internal Server Error")
+}
+
 type DefaultController struct {
     Handlers map[string]func(*Txn)
     Conf     *ControllerConfig
@@ -133,18 +356,40 @@ func (this *DefaultController) Config() *ControllerConfig {
     return this.Conf
 }
 func (this *DefaultController) HandleRequest(txn *Txn) {
-    handler := this.Handlers[txn.Request.Method()]
-    if handler == nil {
-        handler = this.Handlers["ALL"]
-    }
+    handler := methodHandler(this.Handlers, txn.Request.Method())
     if handler == nil {
-        //not found!
-        //TODO: method not allowed 
+        //method not allowed
+        na := &MethodNotAllowedController{Allow: handlerMethods(this.Handlers)}
+        na.HandleRequest(txn)
         return
     }
     handler(txn)
 }
 
+// finds the handler for the method, falls back to the ALL handler.
+// HEAD requests are served by the GET handler
+func methodHandler(handlers map[string]func(*Txn), method string) func(*Txn) {
+    handler := handlers[method]
+    if handler == nil && method == "HEAD" {
+        handler = handlers["GET"]
+    }
+    if handler == nil {
+        handler = handlers["ALL"]
+    }
+    return handler
+}
+
+// the methods that have a handler, in Allow list order
+func handlerMethods(handlers map[string]func(*Txn)) []string {
+    allow := make([]string, 0)
+    for _, m := range routeMethods {
+        if methodHandler(handlers, m) != nil || m == "OPTIONS" {
+            allow = append(allow, m)
+        }
+    }
+    return allow
+}
+
 // creates a new controller for the specified route for a specific method types (GET, POST, PUT, ect)
 func NewController(route string, methods []string, handler func(*Txn)) *DefaultController {
     // def := new(DefaultController)
@@ -0,0 +1,156 @@
+package cheshire
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collects the written responses
+type testWriter struct {
+	lock      sync.Mutex
+	responses []*Response
+}
+
+func (this *testWriter) Write(response *Response) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.responses = append(this.responses, response)
+	return 0, nil
+}
+
+func (this *testWriter) Type() string {
+	return "test"
+}
+
+func (this *testWriter) written() []*Response {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return append([]*Response{}, this.responses...)
+}
+
+func TestTxnContextCancel(t *testing.T) {
+	conf := NewServerConfig()
+	writer := &testWriter{}
+	ctx, disconnect := context.WithCancel(conf.Context())
+
+	started := make(chan *Txn)
+	stopped := make(chan bool)
+	controller := NewController("/firehose", []string{"GET"}, func(txn *Txn) {
+		started <- txn
+		<-txn.Context().Done()
+		stopped <- true
+	})
+	go HandleRequestContext(ctx, NewRequest("/firehose", "GET"), writer, controller, conf)
+
+	txn := <-started
+	disconnect()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Txn context was not cancelled on disconnect")
+	}
+	_, err := txn.Write(NewResponse(txn))
+	if err == nil || len(writer.written()) != 0 {
+		t.Errorf("Write after disconnect should fail")
+	}
+}
+
+func TestTxnCompletedWrite(t *testing.T) {
+	conf := NewServerConfig()
+	writer := &testWriter{}
+	txn := NewTxn(NewRequest("/ping", "GET"), writer, nil, conf)
+
+	response := NewResponse(txn)
+	response.SetTxnContinue()
+	txn.Write(response)
+	if txn.Context().Err() != nil {
+		t.Errorf("Context should be live until the txn completes")
+	}
+	txn.Write(NewResponse(txn))
+	if txn.Context().Err() == nil {
+		t.Errorf("Context should be cancelled once the txn completes")
+	}
+	txn.Write(NewResponse(txn))
+	if len(writer.written()) != 2 {
+		t.Errorf("Expected 2 writes, got %d", len(writer.written()))
+	}
+}
+
+func TestTxnDeadline(t *testing.T) {
+	conf := NewServerConfig()
+	conf.RequestTimeout = time.Hour
+	writer := &testWriter{}
+
+	done := make(chan *Txn)
+	controller := NewController("/slow", []string{"GET"}, func(txn *Txn) {
+		<-txn.Context().Done()
+		done <- txn
+	})
+	controller.Config().Timeout = 20 * time.Millisecond
+	go HandleRequest(NewRequest("/slow", "GET"), writer, controller, conf)
+
+	var txn *Txn
+	select {
+	case txn = <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Txn context was not cancelled at the deadline")
+	}
+	txn.Write(NewResponse(txn))
+
+	written := writer.written()
+	if len(written) != 1 || written[0].StatusCode() != 504 {
+		t.Errorf("Expected a single 504 response, got %v", written)
+	}
+}
+
+func TestTxnDeadlineStream(t *testing.T) {
+	conf := NewServerConfig()
+	writer := &testWriter{}
+
+	controller := NewController("/stream", []string{"GET"}, func(txn *Txn) {
+		chunk := NewResponse(txn)
+		chunk.SetTxnContinue()
+		txn.Write(chunk)
+		time.Sleep(100 * time.Millisecond)
+		txn.Write(NewResponse(txn))
+	})
+	controller.Config().Timeout = 50 * time.Millisecond
+	request := NewRequest("/stream", "GET")
+	request.SetTxnAcceptMulti()
+	HandleRequest(request, writer, controller, conf)
+
+	written := writer.written()
+	if len(written) != 2 {
+		t.Fatalf("Expected the stream to outlive the deadline, got %v", written)
+	}
+	for _, response := range written {
+		if response.StatusCode() != 200 {
+			t.Errorf("Expected no 504 once the stream started, got %v", written)
+		}
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	conf := NewServerConfig()
+	var recovered interface{}
+	conf.PanicHandler = func(txn *Txn, err interface{}, stack []byte) {
+		recovered = err
+	}
+	writer := &testWriter{}
+	request := NewRequest("/panic", "GET")
+	request.SetTxnId("t1")
+	controller := NewController("/panic", []string{"GET"}, func(txn *Txn) {
+		panic("oh no")
+	})
+	HandleRequest(request, writer, controller, conf)
+
+	if recovered != "oh no" {
+		t.Errorf("Panic handler was not called")
+	}
+	written := writer.written()
+	if len(written) != 1 || written[0].StatusCode() != 500 || written[0].TxnId() != "t1" {
+		t.Errorf("Expected a 500 response, got %v", written)
+	}
+}
@@ -0,0 +1,116 @@
+package cheshire
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How often a comment is sent on an idle event stream so proxies
+// don't close the connection.
+var EventStreamHeartbeat = 15 * time.Second
+
+// Should the responses to this http request be sent as server sent events.
+// either the client accepts text/event-stream or the controller is configured
+// with EventStream
+func wantsEventStream(req *http.Request, controller Controller) bool {
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		return true
+	}
+	conf := controller.Config()
+	return conf != nil && conf.EventStream
+}
+
+// Writes the event stream headers and starts the heartbeats.
+// The stream is always a 200, errors are sent as events.
+// returns a func that stops the heartbeats, which must be called before
+// the http handler returns.
+func (this *HttpWriter) startEventStream() func() {
+	if this.Request.TxnId() == "" {
+		this.Request.SetTxnId(NewTxnId())
+	}
+	if this.HttpRequest.Header.Get("Strest-Txn-Accept") == "" {
+		//EventSource can't set headers, assume a stream
+		this.Request.SetTxnAccept("multi")
+	}
+
+	this.lock.Lock()
+	header := this.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	this.Writer.WriteHeader(200)
+	this.flush()
+	this.lock.Unlock()
+
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(EventStreamHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if this.heartbeat() != nil {
+					return
+				}
+			case <-stop:
+				return
+			case <-this.HttpRequest.Context().Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+func (this *HttpWriter) heartbeat() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.finished {
+		return fmt.Errorf("Event stream finished")
+	}
+	_, err := this.Writer.Write([]byte(": heartbeat\n\n"))
+	if err != nil {
+		return err
+	}
+	this.flush()
+	return nil
+}
+
+// writes the response as a single event, the id is the txn id.
+// the stream is finished once a completed response is written.
+func (this *HttpWriter) writeEvent(response *Response) (int, error) {
+	json, err := response.MarshalJSON()
+	if err != nil {
+		return 0, err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.finished {
+		return 0, fmt.Errorf("Event stream finished")
+	}
+	//json is marshalled without newlines so fits on one data line
+	b, err := fmt.Fprintf(this.Writer, "id: %s\ndata: %s\n\n", response.TxnId(), json)
+	if err != nil {
+		return b, err
+	}
+	this.flush()
+	if response.TxnComplete() {
+		this.finished = true
+	}
+	return b, nil
+}
+
+func (this *HttpWriter) flush() {
+	flusher, ok := this.Writer.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,79 @@
+package cheshire
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStream(t *testing.T) {
+	heartbeat := EventStreamHeartbeat
+	EventStreamHeartbeat = 10 * time.Millisecond
+	defer func() { EventStreamHeartbeat = heartbeat }()
+
+	conf := NewServerConfig()
+	stream := func(txn *Txn) {
+		for i := 0; i < 2; i++ {
+			response := NewResponse(txn)
+			response.SetTxnContinue()
+			txn.Write(response)
+		}
+		//long enough for a heartbeat
+		time.Sleep(50 * time.Millisecond)
+		txn.Write(NewResponse(txn))
+		//ignored, the stream is finished
+		txn.Write(NewResponse(txn))
+	}
+	conf.Register([]string{"GET"}, NewController("/stream", []string{"GET"}, stream))
+	controller := NewController("/events", []string{"GET"}, stream)
+	controller.Config().EventStream = true
+	conf.Register([]string{"GET"}, controller)
+
+	server := httptest.NewServer(&httpHandler{conf})
+	defer server.Close()
+
+	get := func(uri string, accept string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", server.URL+uri, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	for _, uri := range []string{"/stream", "/events"} {
+		res, body := get(uri, "text/event-stream")
+		if res.Header.Get("Content-Type") != "text/event-stream" {
+			t.Errorf("%s: Expected an event stream, got %s", uri, res.Header.Get("Content-Type"))
+		}
+		if c := strings.Count(body, "data: "); c != 3 {
+			t.Errorf("%s: Expected 3 events, got %d: %s", uri, c, body)
+		}
+		if !strings.HasPrefix(body, ": heartbeat") && !strings.Contains(body, "\n: heartbeat\n\n") {
+			t.Errorf("%s: Expected a heartbeat: %s", uri, body)
+		}
+		events := strings.Split(strings.TrimSpace(body), "\n\n")
+		last := events[len(events)-1]
+		if !strings.HasPrefix(last, "id: ") || !strings.Contains(last, `"completed"`) {
+			t.Errorf("%s: Expected the last event to be completed with an id: %s", uri, last)
+		}
+	}
+
+	//route option forces the stream without the accept header
+	res, _ := get("/events", "")
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Expected the route option to send an event stream")
+	}
+	res, body := get("/stream", "")
+	if res.Header.Get("Content-Type") != "application/json" || strings.Contains(body, "data: ") {
+		t.Errorf("Expected json without the accept header, got %s", body)
+	}
+}
@@ -0,0 +1,103 @@
+package cheshire
+
+import (
+	"strings"
+)
+
+// A group of routes that share a route prefix and filters.
+// Controllers registered through the group have the prefix prepended
+// to their route, and the group filters run before the controller's own filters.
+//
+// Groups can be nested:
+//
+//	admin := bootstrap.Group("/v1/admin", authFilter)
+//	admin.RegisterApi("/users", "GET", ListUsers)
+//	admin.Group("/audit", auditFilter).RegisterApi("/log", "GET", AuditLog)
+type RouteGroup struct {
+	Prefix  string
+	Filters []ControllerFilter
+
+	//where controllers are registered to
+	register func([]string, Controller)
+}
+
+// Creates a new group that registers to the given func
+func newRouteGroup(prefix string, filters []ControllerFilter, register func([]string, Controller)) *RouteGroup {
+	return &RouteGroup{
+		Prefix:   strings.TrimRight(prefix, "/"),
+		Filters:  filters,
+		register: register,
+	}
+}
+
+// Creates a route group that will be registered when the bootstrap is initialized.
+// see RegisterApi
+func Group(prefix string, filters ...ControllerFilter) *RouteGroup {
+	return newRouteGroup(prefix, filters, Register)
+}
+
+// Creates a route group that registers directly with the Router
+func (this *ServerConfig) Group(prefix string, filters ...ControllerFilter) *RouteGroup {
+	return newRouteGroup(prefix, filters, this.Register)
+}
+
+// Creates a route group that registers directly with the Router
+func (this *Bootstrap) Group(prefix string, filters ...ControllerFilter) *RouteGroup {
+	return this.Conf.Group(prefix, filters...)
+}
+
+// Creates a nested group, the prefix and filters are
+// appended to this groups prefix and filters.
+func (this *RouteGroup) Group(prefix string, filters ...ControllerFilter) *RouteGroup {
+	f := append(make([]ControllerFilter, 0, len(this.Filters)+len(filters)), this.Filters...)
+	f = append(f, filters...)
+	return newRouteGroup(this.route(prefix), f, this.register)
+}
+
+// the full route for a route in this group
+func (this *RouteGroup) route(route string) string {
+	if !strings.HasPrefix(route, "/") {
+		route = "/" + route
+	}
+	return this.Prefix + route
+}
+
+// Registers a controller funtion for api calls
+// returns the controller config so the route can be named, see ControllerConfig.Named
+func (this *RouteGroup) RegisterApi(route string, method string, handler func(*Txn), filters ...ControllerFilter) *ControllerConfig {
+	m := strings.ToUpper(method)
+
+	controller := NewController(route, []string{m}, handler)
+	controller.Config().Filters = filters
+	this.Register([]string{m}, controller)
+	return controller.Config()
+}
+
+// Registers a controller function for html pages
+// returns the controller config so the route can be named, see ControllerConfig.Named
+func (this *RouteGroup) RegisterHtml(route string, method string, handler func(*Txn), filters ...ControllerFilter) *ControllerConfig {
+	m := strings.ToUpper(method)
+
+	controller := NewHtmlController(route, []string{m}, handler)
+	controller.Config().Filters = filters
+	this.Register([]string{m}, controller)
+	return controller.Config()
+}
+
+// Registers a new controller.
+// The controller's route and filters are updated to include the group prefix and filters.
+// Registering the same controller again (i.e. for other methods) starts from its
+// original route and filters, so the prefix and filters are only added once.
+func (this *RouteGroup) Register(methods []string, controller Controller) {
+	conf := controller.Config()
+	if conf != nil {
+		if conf.ungrouped == nil {
+			conf.ungrouped = &ControllerConfig{Route: conf.Route, Filters: conf.Filters}
+		}
+		base := conf.ungrouped
+		conf.Route = this.route(base.Route)
+		f := append(make([]ControllerFilter, 0, len(this.Filters)+len(base.Filters)), this.Filters...)
+		conf.Filters = append(f, base.Filters...)
+	}
+	this.register(methods, controller)
+}
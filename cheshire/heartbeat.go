@@ -0,0 +1,72 @@
+package cheshire
+
+import (
+	"context"
+	"github.com/trendrr/goshire/dynmap"
+	"net"
+	"time"
+)
+
+// Heartbeats are asked for in the hello with the "heartbeat" key, the interval
+// in milliseconds.  Both sides then send a heartbeat every interval so either
+// side can detect a dead peer by a read deadline.  Decoders skip heartbeats.
+
+// The json heartbeat packet
+var jsonHeartbeat = []byte(`{"strest":{"heartbeat":true}}`)
+
+// The binary frame flag for a heartbeat, see writeBinFrame
+const binHeartbeatFrame = int8(2)
+
+// the heartbeat interval the client asked for, 0 for none
+func helloHeartbeat(hello *dynmap.DynMap) time.Duration {
+	if hello == nil {
+		return 0
+	}
+	ms := hello.MustInt64("heartbeat", 0)
+	if ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// Reads from the connection, extending its read deadline before every read
+// so reads fail once nothing (not even a heartbeat) has been received
+// for the Timeout.  0 leaves the deadline alone.
+type IdleReader struct {
+	Conn    net.Conn
+	Timeout time.Duration
+}
+
+func (this *IdleReader) Read(p []byte) (int, error) {
+	if this.Timeout > 0 {
+		err := this.Conn.SetReadDeadline(time.Now().Add(this.Timeout))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return this.Conn.Read(p)
+}
+
+// strest connection writers that can send heartbeats
+type heartbeatWriter interface {
+	writeHeartbeat() error
+}
+
+// sends a heartbeat every interval until the ctx is done or a write fails
+func sendHeartbeats(ctx context.Context, writer heartbeatWriter, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if writer.writeHeartbeat() != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
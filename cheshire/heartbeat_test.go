@@ -0,0 +1,78 @@
+package cheshire
+
+import (
+	"bytes"
+	"github.com/trendrr/goshire/dynmap"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatFrames(t *testing.T) {
+	protocols := map[string]Protocol{
+		"json": &JSONProtocol{Heartbeat: time.Second},
+		"bin":  &BinProtocol{Heartbeat: time.Second},
+	}
+	for name, protocol := range protocols {
+		var buf bytes.Buffer
+		protocol.WriteHello(&buf, dynmap.New())
+		for _, uri := range []string{"/one", "/two"} {
+			protocol.WriteHeartbeat(&buf)
+			protocol.WriteHeartbeat(&buf)
+			req := NewRequest(uri, "GET")
+			req.SetTxnId(uri)
+			_, err := protocol.WriteRequest(req, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		dec := JSON.NewDecoder(&buf)
+		if name == "bin" {
+			dec = BIN.NewDecoder(&buf)
+		}
+		hello, err := dec.DecodeHello()
+		if err != nil || helloHeartbeat(hello) != time.Second {
+			t.Fatalf("%s: expected the heartbeat in the hello %v %s", name, hello, err)
+		}
+		for _, uri := range []string{"/one", "/two"} {
+			req, err := dec.DecodeRequest()
+			if err != nil || req.Uri() != uri {
+				t.Fatalf("%s: expected heartbeats to be skipped, got %v %s", name, req, err)
+			}
+		}
+	}
+
+	if BIN.WriteHeartbeat(&bytes.Buffer{}) == nil {
+		t.Errorf("Expected an error, heartbeats were not negotiated")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	conf := NewServerConfig()
+	conf.IdleTimeout = 50 * time.Millisecond
+	conn := startUnixServer(t, conf, JsonListenUnix)()
+
+	//ask for heartbeats, and keep sending them for a while
+	(&JSONProtocol{Heartbeat: 10 * time.Millisecond}).WriteHello(conn, dynmap.New())
+	received := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(conn)
+		received <- string(b)
+	}()
+	for i := 0; i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+		JSON.WriteHeartbeat(conn)
+	}
+
+	//then go idle
+	select {
+	case b := <-received:
+		if !strings.Contains(b, `"heartbeat"`) {
+			t.Errorf("Expected heartbeats from the server, got %s", b)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the idle connection to be closed")
+	}
+}
@@ -0,0 +1,135 @@
+package cheshire
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/trendrr/goshire/dynmap"
+	"io"
+	"strconv"
+)
+
+// The optional protocol features this implementation supports.
+// Clients send theirs in the hello as "features", the server replies with
+// its own hello listing the features both support.
+var Features = []string{"cancel", "heartbeat", "compression", "msgpack", "content_stream"}
+
+// The negotiated hello of a json, binary or websocket connection.
+// Available to controllers as txn.Handshake
+type Handshake struct {
+	//The hello the client sent, empty if it sent none
+	Hello *dynmap.DynMap
+	//The strest version both sides speak, the lower of the two
+	Version float32
+	//The clients user agent
+	UserAgent string
+	//The features both sides support, empty for clients that did not send theirs
+	Features []string
+}
+
+// Builds the handshake from the peers hello, using the
+// intersection of its features and ours
+func NewHandshake(hello *dynmap.DynMap) *Handshake {
+	if hello == nil {
+		hello = dynmap.New()
+	}
+	version := StrestVersion
+	v, err := strconv.ParseFloat(hello.MustString("v", ""), 32)
+	if err == nil && v > 0 && float32(v) < version {
+		version = float32(v)
+	}
+	features, _ := hello.GetStringSlice("features")
+	return &Handshake{
+		Hello:     hello,
+		Version:   version,
+		UserAgent: hello.MustString("useragent", ""),
+		Features:  intersectFeatures(features, Features),
+	}
+}
+
+// Do both sides support the feature
+func (this *Handshake) Supports(feature string) bool {
+	for _, f := range this.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// only clients that send their features expect a hello back,
+// older clients would not know what to do with it
+func (this *Handshake) replyExpected() bool {
+	_, ok := this.Hello.Get("features")
+	return ok
+}
+
+// Writes our hello back to the client, if it expects one.
+// The protocol adds the agreed param encoding, compression and heartbeat.
+// If authentication failed the reply carries the 401 status.
+// The hello is written in a single write, so it is one websocket frame
+func (this *Handshake) writeReply(protocol Protocol, writer io.Writer, authErr error) error {
+	if !this.replyExpected() {
+		return nil
+	}
+	hello := dynmap.New()
+	hello.Put("v", this.Version)
+	hello.Put("useragent", "goshire")
+	hello.Put("features", this.Features)
+	if authErr != nil {
+		hello.Put("status", UnauthorizedStatus)
+		hello.Put("status_message", authErr.Error())
+	}
+	var buf bytes.Buffer
+	err := protocol.WriteHello(&buf, hello)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(buf.Bytes())
+	return err
+}
+
+// Authenticates the clients hello and writes our hello back.
+// If authentication fails a 401 follows (for clients that don't read the
+// reply) and an error is returned, the connection should then be closed.
+func (this *connState) greet(hello *dynmap.DynMap, protocol Protocol, writer io.Writer, serverConfig *ServerConfig) error {
+	authErr := this.authenticate(hello, serverConfig)
+	this.handshake = NewHandshake(hello)
+	err := this.handshake.writeReply(protocol, writer, authErr)
+	if err != nil {
+		return err
+	}
+	if authErr == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	_, err = protocol.WriteResponse(NewError(NewRequest("", ""), UnauthorizedStatus, authErr.Error()), &buf)
+	if err == nil {
+		_, err = writer.Write(buf.Bytes())
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("Connection not authenticated: %s", authErr)
+}
+
+// The protocol to use on a connection, based on the base protocol
+// (json or bin) and the settings in the hello
+func NegotiatedProtocol(protocol Protocol, hello *dynmap.DynMap) Protocol {
+	if protocol.Type() == BIN.Type() {
+		return binProtocolForHello(hello)
+	}
+	return jsonProtocolForHello(hello)
+}
+
+func intersectFeatures(a, b []string) []string {
+	features := make([]string, 0)
+	for _, f := range a {
+		for _, g := range b {
+			if f == g {
+				features = append(features, f)
+				break
+			}
+		}
+	}
+	return features
+}
@@ -0,0 +1,56 @@
+package cheshire
+
+import (
+	"bytes"
+	"github.com/trendrr/goshire/dynmap"
+	"reflect"
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	hello := dynmap.New()
+	hello.Put("v", "1.5")
+	hello.Put("useragent", "test")
+	hello.Put("features", []string{"cancel", "teleport", "heartbeat"})
+	handshake := NewHandshake(hello)
+	if handshake.Version != 1.5 || handshake.UserAgent != "test" {
+		t.Errorf("Bad handshake %v", handshake)
+	}
+	if !reflect.DeepEqual(handshake.Features, []string{"cancel", "heartbeat"}) {
+		t.Errorf("Expected the common features, got %v", handshake.Features)
+	}
+	if !handshake.Supports("cancel") || handshake.Supports("teleport") || handshake.Supports("msgpack") {
+		t.Errorf("Bad supports for %v", handshake.Features)
+	}
+
+	//newer clients speak our version
+	hello.Put("v", "99")
+	if NewHandshake(hello).Version != StrestVersion {
+		t.Errorf("Expected version %f", StrestVersion)
+	}
+
+	var buf bytes.Buffer
+	err := handshake.writeReply(JSON, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := JSON.NewDecoder(&buf).DecodeHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	features, _ := reply.GetStringSlice("features")
+	if !reflect.DeepEqual(features, handshake.Features) || reply.MustString("useragent", "") != "goshire" {
+		t.Errorf("Bad reply %v", reply.Map)
+	}
+
+	//older clients get no reply and no features
+	old := NewHandshake(nil)
+	if len(old.Features) != 0 || old.Version != StrestVersion {
+		t.Errorf("Bad handshake without a hello %v", old)
+	}
+	buf.Reset()
+	old.writeReply(JSON, &buf, nil)
+	if buf.Len() != 0 {
+		t.Errorf("Expected no reply to a hello without features, got %s", buf.String())
+	}
+}
@@ -57,6 +57,7 @@ func contxt(txn *Txn, context map[string]interface{}) map[string]interface{} {
 
 	context["request"] = txn.Request
 	context["params"] = txn.Request.Params().Map
+	context["urls"] = namedURLs(txn.ServerConfig.Router)
 
 	flash, ok := txn.Session.GetDynMapSlice("_flash")
 	if ok {
@@ -75,13 +76,45 @@ func writeResponse(txn *Txn, contentType string, value interface{}) {
 	writer, err := ToHttpWriter(txn)
 	if err != nil {
 		SendError(txn, 400, fmt.Sprintf("Error: %s", err))
+		return
 	}
 	if !beforeWrite(txn, writer) {
 		return
 	}
-	writer.Writer.Header().Set("Content-Type", contentType)
-	writer.Writer.WriteHeader(200)
-	writeContent(writer, value)
+	err = writePage(txn, writer, 200, "Content-Type", contentType, value)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// Writes the status, the header and the body then completes the txn.
+// Like writeHttpChunk this holds the txn write lock and stops the deadline,
+// so a 504 can't be written in the middle of the page or before it.
+func writePage(txn *Txn, writer *HttpWriter, status int, header, value string, body interface{}) error {
+	txn.writeLock.Lock()
+	defer txn.writeLock.Unlock()
+	if err := txn.Context().Err(); err != nil {
+		return err
+	}
+	txn.stopDeadline()
+	defer txn.complete()
+
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	if writer.finished {
+		return fmt.Errorf("Http response finished")
+	}
+	started := true
+	writer.headerWritten.Do(func() {
+		writer.Writer.Header().Set(header, value)
+		writer.Writer.WriteHeader(status)
+		started = false
+	})
+	if started {
+		return fmt.Errorf("Http response already started")
+	}
+	writeContent(writer, body)
+	return nil
 }
 
 // call the html hooks.
@@ -116,13 +149,15 @@ func Redirect(txn *Txn, url string) {
 	writer, err := ToHttpWriter(txn)
 	if err != nil {
 		SendError(txn, 400, fmt.Sprintf("Error: %s", err))
+		return
 	}
 	if !beforeWrite(txn, writer) {
 		return
 	}
-	writer.Writer.Header().Set("Location", url)
-	writer.Writer.WriteHeader(301)
-	writeContent(writer, "<html><head><title>Moved</title></head><body><h1>Moved</h1><p>This page has moved to <a href=\"%s\">%s</a>.</p></body></html>")
+	err = writePage(txn, writer, 301, "Location", url, "<html><head><title>Moved</title></head><body><h1>Moved</h1><p>This page has moved to <a href=\"%s\">%s</a>.</p></body></html>")
+	if err != nil {
+		log.Print(err)
+	}
 }
 
 //write out an object 
@@ -164,6 +199,9 @@ func (this *HtmlController) Config() *ControllerConfig {
 // mostly this is so the filters know this is of type="html" 
 func (this *HtmlController) HttpHijack(writer http.ResponseWriter, req *http.Request, serverConfig *ServerConfig) {
 	request := ToStrestRequest(req)
+	//hijackers dont get the matched params, so look them up again
+	_, params := serverConfig.Router.Match(req.Method, req.URL.Path)
+	MergeRouteParams(request, params)
 	conn := &HtmlWriter{
 		&HttpWriter{
 			Writer:       writer,
@@ -172,14 +210,13 @@ func (this *HtmlController) HttpHijack(writer http.ResponseWriter, req *http.Req
 			ServerConfig: serverConfig,
 		},
 	}
-	HandleRequest(request, conn, this, serverConfig)
+	//no writes once the handler returns, i.e. a 504 after a filter stopped the txn
+	defer conn.finish()
+	HandleRequestContext(req.Context(), request, conn, this, serverConfig)
 }
 
 func (this *HtmlController) HandleRequest(txn *Txn) {
-	handler := this.Handlers[txn.Request.Method()]
-	if handler == nil {
-		handler = this.Handlers["ALL"]
-	}
+	handler := methodHandler(this.Handlers, txn.Request.Method())
 	if handler == nil {
 		log.Println("Error, not found ", txn.Request.Uri())
 		//not found!
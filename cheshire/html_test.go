@@ -0,0 +1,54 @@
+package cheshire
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// an html filter that stops the page from being written
+type stopHtmlFilter struct{}
+
+func (this *stopHtmlFilter) Before(txn *Txn) bool {
+	return true
+}
+
+func (this *stopHtmlFilter) BeforeHtmlWrite(txn *Txn, writer http.ResponseWriter) bool {
+	return false
+}
+
+func TestRedirectAfterDeadline(t *testing.T) {
+	conf := NewServerConfig()
+	controller := NewHtmlController("/page", []string{"GET"}, func(txn *Txn) {
+		time.Sleep(50 * time.Millisecond)
+		Redirect(txn, "/elsewhere")
+	})
+	controller.Config().Timeout = 10 * time.Millisecond
+	conf.Register([]string{"GET"}, controller)
+
+	recorder := httptest.NewRecorder()
+	controller.HttpHijack(recorder, httptest.NewRequest("GET", "/page", nil), conf)
+	if recorder.Code != 504 || recorder.Header().Get("Location") != "" || strings.Contains(recorder.Body.String(), "Moved") {
+		t.Errorf("Expected only the 504, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestHtmlFilterStopsBeforeDeadline(t *testing.T) {
+	conf := NewServerConfig()
+	controller := NewHtmlController("/page", []string{"GET"}, func(txn *Txn) {
+		Redirect(txn, "/elsewhere")
+	})
+	controller.Config().Timeout = 10 * time.Millisecond
+	controller.Config().Filters = []ControllerFilter{&stopHtmlFilter{}}
+	conf.Register([]string{"GET"}, controller)
+
+	recorder := httptest.NewRecorder()
+	controller.HttpHijack(recorder, httptest.NewRequest("GET", "/page", nil), conf)
+	//past the deadline, nothing may be written once the handler returned
+	time.Sleep(50 * time.Millisecond)
+	if recorder.Body.Len() != 0 || recorder.Header().Get("Location") != "" {
+		t.Errorf("Expected nothing to be written, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
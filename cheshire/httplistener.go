@@ -1,9 +1,12 @@
 package cheshire
 
 import (
+	"compress/gzip"
+	"context"
 	"fmt"
 	"github.com/trendrr/goshire/dynmap"
 	"log"
+	"net"
 	"net/http"
 	// "net/url"
 	"sync"
@@ -18,7 +21,16 @@ type HttpWriter struct {
 	HttpRequest   *http.Request
 	Request       *Request
 	ServerConfig  *ServerConfig
+	// Write responses as server sent events rather then newline delimited json
+	EventStream   bool
+	// The client accepts gzip, large or streamed responses are compressed
+	AcceptGzip    bool
 	headerWritten sync.Once
+	gzip          *gzip.Writer
+
+	//guards writes between event stream heartbeats and responses
+	lock     sync.Mutex
+	finished bool
 }
 
 func (this *HttpWriter) Type() string {
@@ -26,27 +38,48 @@ func (this *HttpWriter) Type() string {
 }
 
 func (conn *HttpWriter) Write(response *Response) (int, error) {
+	if conn.EventStream {
+		return conn.writeEvent(response)
+	}
 	bytes := 0
 	json, err := response.MarshalJSON()
 	if err != nil {
 		//TODO: uhh, do something..
 		log.Print(err)
 	}
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.finished {
+		return bytes, fmt.Errorf("Http response finished")
+	}
 	conn.headerWritten.Do(func() {
 		conn.Writer.Header().Set("Content-Type", "application/json")
+		if conn.AcceptGzip {
+			conn.startGzip(response, json)
+		}
 		conn.Writer.WriteHeader(response.StatusCode())
 	})
-	b, err := conn.Writer.Write(json)
+	var writer io.Writer = conn.Writer
+	if conn.gzip != nil {
+		writer = conn.gzip
+	}
+	b, err := writer.Write(json)
 	if err != nil {
 		return bytes, err
 	}
 	bytes += b
-	b, err = conn.Writer.Write([]byte("\n"))
+	b, err = writer.Write([]byte("\n"))
 	if err != nil {
 		return bytes, err
 	}
 	bytes += b
 
+	if conn.gzip != nil {
+		err = conn.gzip.Flush()
+		if err != nil {
+			return bytes, err
+		}
+	}
 	flusher, ok := conn.Writer.(http.Flusher)
 	if !ok {
 		return bytes, fmt.Errorf("Wrong type in http writer!")
@@ -67,7 +100,7 @@ type HttpHijacker interface {
 }
 
 func (this *httpHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
-	controller := this.serverConfig.Router.Match(req.Method, req.URL.Path)
+	controller, params := this.serverConfig.Router.Match(req.Method, req.URL.Path)
 
 	//check if controller is the special HttpHijacker.
 	h, hijack := controller.(HttpHijacker)
@@ -78,14 +111,24 @@ func (this *httpHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request
 
 	//we are already in a go routine, so no need to start another one.
 	request := ToStrestRequest(req)
+	MergeRouteParams(request, params)
 
 	conn := &HttpWriter{
 		Writer:       writer,
 		HttpRequest:  req,
 		Request:      request,
 		ServerConfig: this.serverConfig,
+		EventStream:  wantsEventStream(req, controller),
+	}
+	if conn.EventStream {
+		stop := conn.startEventStream()
+		defer stop()
+	} else {
+		conn.AcceptGzip = acceptsGzip(req)
+		defer conn.finish()
 	}
-	HandleRequest(request, conn, controller, this.serverConfig)
+	//the request context is cancelled when the client disconnects or the server shuts down
+	HandleRequestContext(req.Context(), request, conn, controller, this.serverConfig)
 }
 
 func ToStrestRequest(req *http.Request) *Request {
@@ -148,8 +191,32 @@ func ReadHttpBody(req *http.Request) ([]byte, error) {
 }
 
 func HttpListen(port int, serverConfig *ServerConfig) error {
-	handler := &httpHandler{serverConfig}
-
+	ln, err := listen(port, serverConfig)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
 	log.Println("HTTP Listener on port: ", port)
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), handler)
+	return httpServe(ln, serverConfig)
+}
+
+// serves http on the listener until the server is shut down
+func httpServe(ln net.Listener, serverConfig *ServerConfig) error {
+	server := &http.Server{
+		Handler: &httpHandler{serverConfig},
+		//request contexts are cancelled when the server shuts down
+		BaseContext: func(net.Listener) context.Context {
+			return serverConfig.Context()
+		},
+	}
+	if !serverConfig.lifecycle.addServer(server) {
+		ln.Close()
+		return nil
+	}
+	err := server.Serve(ln)
+	if err == http.ErrServerClosed {
+		//clean shutdown
+		return nil
+	}
+	return err
 }
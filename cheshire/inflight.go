@@ -0,0 +1,183 @@
+package cheshire
+
+import (
+	"context"
+	"sync"
+)
+
+// Limits the number of txns in flight on a single strest connection
+// and across all connections.  A txn is in flight until its context is done
+// (completed, cancelled or the connection closed).
+type inflightLimiter struct {
+	//nil if unlimited
+	conn   chan bool
+	global chan bool
+	reject bool
+}
+
+func newInflightLimiter(config *ServerConfig) *inflightLimiter {
+	limiter := &inflightLimiter{
+		global: config.globalInflight(),
+		reject: config.RejectWhenBusy,
+	}
+	if config.MaxInFlightPerConn > 0 {
+		limiter.conn = make(chan bool, config.MaxInFlightPerConn)
+	}
+	return limiter
+}
+
+// takes a slot from the limit
+// if full and not in reject mode this blocks until there is room (or ctx is done)
+func acquireSlot(ctx context.Context, slots chan bool, reject bool) bool {
+	if slots == nil {
+		return true
+	}
+	if reject {
+		select {
+		case slots <- true:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case slots <- true:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// acquires a per connection and global slot.
+// returns false if the txn should not be handled.
+func (this *inflightLimiter) acquire(ctx context.Context) bool {
+	if !acquireSlot(ctx, this.conn, this.reject) {
+		return false
+	}
+	if !acquireSlot(ctx, this.global, this.reject) {
+		if this.conn != nil {
+			<-this.conn
+		}
+		return false
+	}
+	return true
+}
+
+// does acquire ever wait for a slot
+func (this *inflightLimiter) blocking() bool {
+	return !this.reject && (this.conn != nil || this.global != nil)
+}
+
+func (this *inflightLimiter) release() {
+	if this.conn != nil {
+		<-this.conn
+	}
+	if this.global != nil {
+		<-this.global
+	}
+}
+
+// The state shared by the txns of a single json, binary or websocket connection
+type connState struct {
+	limiter *inflightLimiter
+	txns    *txnRegistry
+	//set once the hello is decoded
+	handshake *Handshake
+	//set once the hello is authenticated, nil without an authenticator
+	principal *Principal
+
+	//txns waiting for an in flight slot, in the order they were read
+	queue     chan *queuedTxn
+	queueOnce sync.Once
+}
+
+type queuedTxn struct {
+	txn        *Txn
+	controller Controller
+}
+
+func newConnState(config *ServerConfig) *connState {
+	return &connState{
+		limiter:   newInflightLimiter(config),
+		txns:      newTxnRegistry(),
+		handshake: NewHandshake(nil),
+		queue:     make(chan *queuedTxn, config.MaxQueuedPerConn),
+	}
+}
+
+// Queues the txn to start once there is an in flight slot.
+// While the queue has room the reader can still read cancels and heartbeats,
+// once it is full this blocks so the connection stops being read.
+// returns false if ctx is done (the connection closed) first
+func (this *connState) enqueue(ctx context.Context, txn *Txn, controller Controller) bool {
+	this.queueOnce.Do(func() {
+		go this.admit(ctx)
+	})
+	select {
+	case this.queue <- &queuedTxn{txn, controller}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// starts the queued txns as slots free up, until the connection closes
+func (this *connState) admit(ctx context.Context) {
+	for {
+		select {
+		case queued := <-this.queue:
+			txn := queued.txn
+			//fails if the txn was cancelled while waiting
+			if !this.limiter.acquire(txn.Context()) {
+				continue
+			}
+			txn.onRelease(this.limiter.release)
+			if txn.Context().Err() != nil {
+				continue
+			}
+			go serveTxn(txn, queued.controller)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Routes a request decoded from a strest connection and handles it in a new
+// go routine, applying the in flight limits.  When not rejecting busy txns
+// they wait in the connection queue, and this blocks once the queue is full
+// so the reader stops reading (see ServerConfig.MaxQueuedPerConn).
+// cancel requests are handled here against the connections txns.
+// ctx should be cancelled when the connection closes
+func dispatch(ctx context.Context, state *connState, req *Request, conn Writer, serverConfig *ServerConfig) {
+	if req.Method() == CANCEL {
+		//unknown txns have likely already completed
+		state.txns.cancel(req.TxnId())
+		return
+	}
+	controller, params := serverConfig.Router.Match(req.Method(), req.Uri())
+	MergeRouteParams(req, params)
+
+	//registered before the handler starts so a cancel can't be missed
+	txn := newControllerTxn(ctx, req, conn, controller, serverConfig)
+	txn.Handshake = state.handshake
+	txn.Principal = state.principal
+
+	limiter := state.limiter
+	if limiter.blocking() {
+		state.txns.add(txn)
+		if !state.enqueue(ctx, txn, controller) {
+			//the connection closed while waiting
+			txn.cancel()
+		}
+		return
+	}
+	if !limiter.acquire(ctx) {
+		//rejected
+		txn.cancel()
+		conn.Write(NewError(req, 503, "Server too busy"))
+		return
+	}
+	txn.onRelease(limiter.release)
+	state.txns.add(txn)
+	go serveTxn(txn, controller)
+}
@@ -0,0 +1,172 @@
+package cheshire
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestInflightReject(t *testing.T) {
+	conf := NewServerConfig()
+	conf.MaxInFlightPerConn = 1
+	conf.RejectWhenBusy = true
+	block := make(chan bool)
+	conf.Register([]string{"GET"}, NewController("/block", []string{"GET"}, func(txn *Txn) {
+		<-block
+		SendSuccess(txn)
+	}))
+
+	writer := &testWriter{}
+	state := newConnState(conf)
+	limiter := state.limiter
+	ctx := context.Background()
+	dispatch(ctx, state, NewRequest("/block", "GET"), writer, conf)
+	dispatch(ctx, state, NewRequest("/block", "GET"), writer, conf)
+
+	written := writer.written()
+	if len(written) != 1 || written[0].StatusCode() != 503 {
+		t.Fatalf("Expected the second request to be rejected, got %v", written)
+	}
+
+	//once the first completes there is room again
+	block <- true
+	time.Sleep(10 * time.Millisecond)
+	if !limiter.acquire(ctx) {
+		t.Errorf("Slot was not released")
+	}
+}
+
+func TestInflightBlock(t *testing.T) {
+	conf := NewServerConfig()
+	conf.MaxInFlight = 1
+	limiter := newInflightLimiter(conf)
+	if !limiter.acquire(context.Background()) {
+		t.Fatalf("Expected a slot")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if limiter.acquire(ctx) {
+		t.Errorf("Acquire should block until the context is done")
+	}
+}
+
+func TestInflightReleasedWithoutResponse(t *testing.T) {
+	conf := NewServerConfig()
+	conf.MaxInFlightPerConn = 1
+	conf.RejectWhenBusy = true
+	handled := make(chan bool, 5)
+	//writes nothing
+	conf.Register([]string{"GET"}, NewController("/silent", []string{"GET"}, func(txn *Txn) {
+		handled <- true
+	}))
+
+	writer := &testWriter{}
+	state := newConnState(conf)
+	for i := 0; i < 3; i++ {
+		dispatch(context.Background(), state, NewRequest("/silent", "GET"), writer, conf)
+		<-handled
+		time.Sleep(10 * time.Millisecond)
+	}
+	if written := writer.written(); len(written) != 0 {
+		t.Errorf("Expected the slot to be released when the handler returned, got %v", written)
+	}
+}
+
+func TestInflightQueueReadsCancels(t *testing.T) {
+	conf := NewServerConfig()
+	conf.MaxInFlightPerConn = 1
+	conf.MaxQueuedPerConn = 1
+	handled := make(chan string, 5)
+	conf.Register([]string{"GET"}, NewController("/stream", []string{"GET"}, func(txn *Txn) {
+		handled <- txn.TxnId()
+		<-txn.Context().Done()
+	}))
+	conf.Register([]string{"GET"}, NewController("/ping", []string{"GET"}, func(txn *Txn) {
+		handled <- txn.TxnId()
+		SendSuccess(txn)
+	}))
+
+	writer := &testWriter{}
+	state := newConnState(conf)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := NewRequest("/stream", "GET")
+	stream.SetTxnId("stream")
+	stream.SetTxnAcceptMulti()
+	dispatch(ctx, state, stream, writer, conf)
+	<-handled
+
+	//the connection is full but the queue has room, dispatch must not wait for the slot
+	dispatched := make(chan bool)
+	go func() {
+		ping := NewRequest("/ping", "GET")
+		ping.SetTxnId("ping")
+		dispatch(ctx, state, ping, writer, conf)
+		cancelReq := NewRequest("", CANCEL)
+		cancelReq.SetTxnId("stream")
+		dispatch(ctx, state, cancelReq, writer, conf)
+		dispatched <- true
+	}()
+	select {
+	case <-dispatched:
+	case <-time.After(time.Second):
+		t.Fatalf("Dispatch blocked waiting for an in flight slot")
+	}
+
+	select {
+	case id := <-handled:
+		if id != "ping" {
+			t.Errorf("Expected the queued ping, got %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Queued txn never started after the stream was cancelled")
+	}
+}
+
+func TestInflightBackpressure(t *testing.T) {
+	conf := NewServerConfig()
+	conf.MaxInFlightPerConn = 1
+	conf.MaxQueuedPerConn = 1
+	block := make(chan bool)
+	conf.Register([]string{"GET"}, NewController("/block", []string{"GET"}, func(txn *Txn) {
+		<-block
+		SendSuccess(txn)
+	}))
+
+	writer := &testWriter{}
+	state := newConnState(conf)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	//one in flight, one waiting for the slot and one in the queue
+	for i := 0; i < 3; i++ {
+		dispatch(ctx, state, NewRequest("/block", "GET"), writer, conf)
+	}
+	dispatched := make(chan bool)
+	go func() {
+		dispatch(ctx, state, NewRequest("/block", "GET"), writer, conf)
+		dispatched <- true
+	}()
+	select {
+	case <-dispatched:
+		t.Fatalf("Expected dispatch to block once the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	block <- true
+	select {
+	case <-dispatched:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected dispatch to continue once there was room")
+	}
+	for i := 0; i < 3; i++ {
+		block <- true
+	}
+	time.Sleep(10 * time.Millisecond)
+	for _, res := range writer.written() {
+		if res.StatusCode() != 200 {
+			t.Errorf("Expected every txn to be served, got %v", res)
+		}
+	}
+}
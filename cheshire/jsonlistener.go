@@ -2,7 +2,7 @@ package cheshire
 
 import (
 	"bufio"
-	"fmt"
+	"context"
 	"io"
 	"log"
 	"net"
@@ -13,31 +13,65 @@ type JsonWriter struct {
 	serverConfig *ServerConfig
 	conn         net.Conn
 	writerLock   sync.Mutex
+	//set from the hello, defaults to JSON
+	protocol *JSONProtocol
 }
 
 func (this *JsonWriter) Write(response *Response) (int, error) {
 	defer this.writerLock.Unlock()
 	this.writerLock.Lock()
-	bytes, err := JSON.WriteResponse(response, this.conn)
+	protocol := this.protocol
+	if protocol == nil {
+		protocol = JSON
+	}
+	bytes, err := protocol.WriteResponse(response, this.conn)
 	return bytes, err
 }
 
+func (this *JsonWriter) writeHeartbeat() error {
+	defer this.writerLock.Unlock()
+	this.writerLock.Lock()
+	return this.protocol.WriteHeartbeat(this.conn)
+}
+
 func (this *JsonWriter) Type() string {
 	return "json"
 }
 
 func JsonListen(port int, config *ServerConfig) error {
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	defer ln.Close()
+	ln, err := listen(port, config)
 	if err != nil {
 		// handle error
 		log.Println(err)
 		return err
 	}
 	log.Println("Json Listener on port: ", port)
+	return jsonServe(ln, config)
+}
+
+// Listens for json strest connections on a unix socket
+func JsonListenUnix(path string, config *ServerConfig) error {
+	ln, err := listenUnix(path)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	log.Println("Json Listener on socket: ", path)
+	return jsonServe(ln, config)
+}
+
+// accepts json connections until the server is stopped
+func jsonServe(ln net.Listener, config *ServerConfig) error {
+	defer ln.Close()
+	if !config.lifecycle.addListener(ln) {
+		return nil
+	}
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if config.lifecycle.stopping() {
+				return nil
+			}
 			log.Print(err)
 			// handle error
 			continue
@@ -50,9 +84,35 @@ func JsonListen(port int, config *ServerConfig) error {
 func handleJSONConnection(conn *JsonWriter) {
 	defer conn.conn.Close()
 	// log.Print("CONNECT!")
+	if !conn.serverConfig.lifecycle.addConn(conn.conn) {
+		return
+	}
+	defer conn.serverConfig.lifecycle.removeConn(conn.conn)
+
+	//cancelled on disconnect so in flight txns can stop
+	ctx, cancel := context.WithCancel(conn.serverConfig.Context())
+	defer cancel()
+	state := newConnState(conn.serverConfig)
 
 	// dec := json.NewDecoder(bufio.NewReader(conn.conn))
-	dec := JSON.NewDecoder(bufio.NewReader(conn.conn))
+	dec := JSON.NewDecoder(bufio.NewReader(&IdleReader{Conn: conn.conn, Timeout: conn.serverConfig.IdleTimeout}))
+	dec.SetLimits(conn.serverConfig.Limits)
+	hello, err := dec.DecodeHello()
+	if err != nil {
+		log.Print(err)
+		writeLimitError(conn, err)
+		return
+	}
+	protocol := jsonProtocolForHello(hello)
+	conn.writerLock.Lock()
+	conn.protocol = protocol
+	err = state.greet(hello, protocol, conn.conn, conn.serverConfig)
+	conn.writerLock.Unlock()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	go sendHeartbeats(ctx, conn, protocol.Heartbeat)
 	for {
 		req, err := dec.DecodeRequest()
 
@@ -61,10 +121,10 @@ func handleJSONConnection(conn *JsonWriter) {
 			break
 		} else if err != nil {
 			log.Print(err)
+			writeLimitError(conn, err)
 			break
 		}
-		controller := conn.serverConfig.Router.Match(req.Method(), req.Uri())
-		go HandleRequest(req, conn, controller, conn.serverConfig)
+		dispatch(ctx, state, req, conn, conn.serverConfig)
 	}
 
 	log.Print("DISCONNECT!")
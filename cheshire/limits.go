@@ -0,0 +1,127 @@
+package cheshire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Limits on a single packet decoded from a strest connection, so a broken
+// or hostile client can't exhaust the servers memory.  A packet over a limit
+// gets a 413 and the connection is closed, as the rest of the stream can't be trusted.
+type Limits struct {
+	//the largest packet, after decompressing.  0 for no limit
+	//whitespace between json packets is not counted
+	MaxFrameSize int64
+	//the largest encoded params of a request.  0 for no limit
+	MaxParamsSize int64
+	//the largest content of a request.  0 for no limit
+	MaxContentSize int64
+}
+
+// The limits servers use unless configured otherwise.
+// params and content are capped the same as http bodies.
+var DefaultLimits = Limits{
+	MaxFrameSize:   20 << 20,
+	MaxParamsSize:  10 << 20,
+	MaxContentSize: 10 << 20,
+}
+
+// The status sent for a packet over the limits
+const RequestTooLargeStatus = 413
+
+// A packet was larger then the limits allow
+type LimitError struct {
+	//what was too large, frame, params or content
+	What string
+	Max  int64
+	//the txn, if it was decoded before the limit was hit
+	txnId string
+}
+
+func (this *LimitError) Error() string {
+	return fmt.Sprintf("%s larger then the max of %d bytes", this.What, this.Max)
+}
+
+func (this *LimitError) TxnId() string {
+	return this.txnId
+}
+
+// Sends the 413 if the decode error was a packet over the limits.
+// the caller closes the connection after.
+func writeLimitError(conn Writer, err error) {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		conn.Write(NewError(limitErr, RequestTooLargeStatus, limitErr.Error()))
+	}
+}
+
+// sets the txn on a limit error, so the 413 goes to the txn that was too large
+func limitTxn(err error, txnId string) error {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		limitErr.txnId = txnId
+	}
+	return err
+}
+
+// Limits the bytes read for a single packet, reset before each packet
+type frameReader struct {
+	reader    io.Reader
+	max       int64
+	remaining int64
+}
+
+func (this *frameReader) reset() {
+	this.remaining = this.max
+}
+
+func (this *frameReader) Read(p []byte) (int, error) {
+	if this.max <= 0 {
+		return this.reader.Read(p)
+	}
+	if this.remaining <= 0 {
+		return 0, &LimitError{What: "frame", Max: this.max}
+	}
+	if int64(len(p)) > this.remaining {
+		p = p[:this.remaining]
+	}
+	n, err := this.reader.Read(p)
+	this.remaining -= int64(n)
+	return n, err
+}
+
+// Reads length bytes, failing if the length is over max (0 for no max).
+// large arrays are read as they arrive rather then allocated up front,
+// so a bogus length can't allocate more then was actually sent
+func readLimited(reader io.Reader, length int64, max int64, what string) ([]byte, error) {
+	if length < 0 {
+		return nil, fmt.Errorf("%s length is negative", what)
+	}
+	if max > 0 && length > max {
+		return nil, &LimitError{What: what, Max: max}
+	}
+	if length <= 64<<10 {
+		b := make([]byte, length)
+		_, err := io.ReadFull(reader, b)
+		return b, err
+	}
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, reader, length)
+	if err == io.EOF && n < length {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+// reads an int32 length prefixed byte array, see readLimited
+func readByteArray32Limited(reader io.Reader, max int64, what string) ([]byte, error) {
+	length := int32(0)
+	err := binary.Read(reader, binary.BigEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+	return readLimited(reader, int64(length), max, what)
+}
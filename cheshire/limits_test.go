@@ -0,0 +1,269 @@
+package cheshire
+
+import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/go.net/websocket"
+	"encoding/binary"
+	"errors"
+	"github.com/trendrr/goshire/dynmap"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testLimits = Limits{
+	MaxFrameSize:   64 << 10,
+	MaxParamsSize:  16 << 10,
+	MaxContentSize: 16 << 10,
+}
+
+func limitRequest(params int, content int) *Request {
+	req := NewRequest("/limits", "POST")
+	req.SetTxnId("big")
+	req.Params().Put("data", strings.Repeat("a", params))
+	if content > 0 {
+		req.SetContent("bytes", bytes.Repeat([]byte("b"), content))
+	}
+	return req
+}
+
+func expectLimit(t *testing.T, name string, err error, what string) {
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.What != what {
+		t.Errorf("%s: expected a %s limit error, got %v", name, what, err)
+	}
+}
+
+func TestDecoderLimits(t *testing.T) {
+	protocols := map[string]Protocol{
+		"json":      JSON,
+		"json-gzip": &JSONProtocol{Compression: "gzip"},
+		"bin":       BIN,
+		"bin-gzip":  &BinProtocol{Compression: "gzip"},
+	}
+	for name, protocol := range protocols {
+		var buf bytes.Buffer
+		protocol.WriteHello(&buf, dynmap.New())
+		protocol.WriteRequest(limitRequest(1000, 0), &buf)
+		protocol.WriteRequest(limitRequest(20<<10, 0), &buf)
+		dec := JSON.NewDecoder(&buf)
+		if strings.HasPrefix(name, "bin") {
+			dec = BIN.NewDecoder(&buf)
+		}
+		dec.SetLimits(testLimits)
+		_, err := dec.DecodeHello()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		req, err := dec.DecodeRequest()
+		if err != nil || len(req.Params().MustString("data", "")) != 1000 {
+			t.Fatalf("%s: expected the small request, got %s", name, err)
+		}
+		_, err = dec.DecodeRequest()
+		expectLimit(t, name, err, "params")
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) && limitErr.TxnId() != "big" {
+			t.Errorf("%s: expected the txn id on the error, got %s", name, limitErr.TxnId())
+		}
+
+		//a frame larger then the max
+		buf.Reset()
+		protocol.WriteHello(&buf, dynmap.New())
+		protocol.WriteRequest(limitRequest(100<<10, 0), &buf)
+		dec = JSON.NewDecoder(&buf)
+		if strings.HasPrefix(name, "bin") {
+			dec = BIN.NewDecoder(&buf)
+		}
+		dec.SetLimits(Limits{MaxFrameSize: testLimits.MaxFrameSize})
+		dec.DecodeHello()
+		_, err = dec.DecodeRequest()
+		expectLimit(t, name, err, "frame")
+	}
+
+	var buf bytes.Buffer
+	BIN.WriteRequest(limitRequest(10, 20<<10), &buf)
+	dec := BIN.NewDecoder(&buf)
+	dec.SetLimits(testLimits)
+	_, err := dec.DecodeRequest()
+	expectLimit(t, "content", err, "content")
+
+	//no limits
+	buf.Reset()
+	BIN.WriteRequest(limitRequest(100<<10, 100<<10), &buf)
+	_, err = BIN.NewDecoder(&buf).DecodeRequest()
+	if err != nil {
+		t.Errorf("Expected no limits by default, got %s", err)
+	}
+}
+
+// a request that encodes to exactly size bytes
+func requestOfSize(t *testing.T, protocol Protocol, size int) *Request {
+	var buf bytes.Buffer
+	protocol.WriteRequest(limitRequest(0, 0), &buf)
+	if buf.Len() > size {
+		t.Fatalf("%s: requests are at least %d bytes", protocol.Type(), buf.Len())
+	}
+	return limitRequest(size-buf.Len(), 0)
+}
+
+func TestDecoderLimitsNearMax(t *testing.T) {
+	max := int(testLimits.MaxFrameSize)
+	for _, protocol := range []Protocol{JSON, BIN} {
+		name := protocol.Type()
+		//after the larger packets the json decoder has room to read well
+		//ahead, so the small packets are followed by large ones
+		sizes := []int{max, max - 1, 200, max, 200, max + 1}
+		var buf bytes.Buffer
+		protocol.WriteHello(&buf, dynmap.New())
+		for _, size := range sizes {
+			protocol.WriteRequest(requestOfSize(t, protocol, size), &buf)
+		}
+		dec := protocol.NewDecoder(bufio.NewReader(&buf))
+		dec.SetLimits(Limits{MaxFrameSize: testLimits.MaxFrameSize})
+		_, err := dec.DecodeHello()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		for i, size := range sizes[:len(sizes)-1] {
+			_, err = dec.DecodeRequest()
+			if err != nil {
+				t.Fatalf("%s: expected packet %d of %d bytes to decode, got %s", name, i, size, err)
+			}
+		}
+		_, err = dec.DecodeRequest()
+		expectLimit(t, name, err, "frame")
+	}
+}
+
+// starts a binary server with the limits and connects to it
+func dialLimited(t *testing.T, limits Limits) net.Conn {
+	conf := NewServerConfig()
+	conf.Limits = limits
+	return startUnixServer(t, conf, BinaryListenUnix)()
+}
+
+func TestLimitResponse(t *testing.T) {
+	conn := dialLimited(t, testLimits)
+
+	BIN.WriteHello(conn, dynmap.New())
+	//claims 1GB of content
+	var buf bytes.Buffer
+	BIN.WriteRequest(limitRequest(10, 0), &buf)
+	packet := buf.Bytes()
+	binary.BigEndian.PutUint32(packet[len(packet)-4:], 1<<30)
+	conn.Write(packet)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	dec := BIN.NewDecoder(conn)
+	res, err := dec.DecodeResponse()
+	if err != nil || res.StatusCode() != RequestTooLargeStatus || res.TxnId() != "big" {
+		t.Fatalf("Expected a 413 for the txn, got %v %s", res, err)
+	}
+	_, err = dec.DecodeResponse()
+	if err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %s", err)
+	}
+}
+
+func TestLimitHello(t *testing.T) {
+	conn := dialLimited(t, Limits{MaxFrameSize: 100})
+	hello := dynmap.New()
+	hello.Put("useragent", strings.Repeat("a", 200))
+	BIN.WriteHello(conn, hello)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	dec := BIN.NewDecoder(conn)
+	res, err := dec.DecodeResponse()
+	if err != nil || res.StatusCode() != RequestTooLargeStatus {
+		t.Fatalf("Expected a 413 for the hello, got %v %s", res, err)
+	}
+	_, err = dec.DecodeResponse()
+	if err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %s", err)
+	}
+}
+
+func TestLimitWebsocketHello(t *testing.T) {
+	conf := NewServerConfig()
+	conf.Limits = Limits{MaxFrameSize: 100}
+	conf.Register([]string{"GET"}, NewWebsocketController("/ws", conf))
+	server := httptest.NewServer(&httpHandler{conf})
+	defer server.Close()
+
+	for _, protocol := range []Protocol{JSON, BIN} {
+		config, err := websocket.NewConfig("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if protocol == BIN {
+			config.Protocol = []string{WebsocketBinProtocol}
+		}
+		ws, err := websocket.DialConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		if protocol == BIN {
+			ws.PayloadType = websocket.BinaryFrame
+		}
+		hello := dynmap.New()
+		hello.Put("useragent", strings.Repeat("a", 200))
+		var buf bytes.Buffer
+		if protocol == JSON {
+			//json only sends a hello when there is something to negotiate
+			hello.Put("heartbeat", 1000)
+		}
+		protocol.WriteHello(&buf, hello)
+		ws.Write(buf.Bytes())
+
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		res, err := protocol.NewDecoder(ws).DecodeResponse()
+		if err != nil || res.StatusCode() != RequestTooLargeStatus {
+			t.Errorf("%s: expected a 413 for the hello, got %v %s", protocol.Type(), res, err)
+		}
+	}
+}
+
+func FuzzBinDecoder(f *testing.F) {
+	msgpack, _ := NewBinProtocol("msgpack")
+	protocols := []*BinProtocol{BIN, msgpack, &BinProtocol{Compression: "gzip", Heartbeat: time.Second}}
+	for _, protocol := range protocols {
+		var buf bytes.Buffer
+		protocol.WriteHello(&buf, dynmap.New())
+		protocol.WriteHeartbeat(&buf)
+		req := limitRequest(5000, 100)
+		req.Params().PutWithDot("nested.list", []interface{}{1, "two", 3.0})
+		protocol.WriteRequest(req, &buf)
+		protocol.WriteResponse(NewResponse(req), &buf)
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte{0, 0, 2, '{', '}', 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		limits := Limits{MaxFrameSize: 1 << 20, MaxParamsSize: 1 << 20, MaxContentSize: 1 << 20}
+		dec := BIN.NewDecoder(bytes.NewReader(data))
+		dec.SetLimits(limits)
+		_, err := dec.DecodeHello()
+		if err != nil {
+			return
+		}
+		for i := 0; i < 10; i++ {
+			_, err = dec.DecodeRequest()
+			if err != nil {
+				break
+			}
+		}
+		dec = BIN.NewDecoder(bytes.NewReader(data))
+		dec.SetLimits(limits)
+		for i := 0; i < 10; i++ {
+			_, err = dec.DecodeResponse()
+			if err != nil {
+				break
+			}
+		}
+	})
+}
@@ -0,0 +1,399 @@
+package cheshire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/trendrr/goshire/dynmap"
+	"math"
+	"reflect"
+)
+
+// A minimal MessagePack (https://msgpack.org) encoder and decoder for params.
+// Maps decode to map[string]interface{}, arrays to []interface{},
+// integers to int64 (uint64 if too large) and floats to float64.
+
+// Nested maps and arrays deeper then this are refused when decoding
+const msgpackMaxDepth = 100
+
+// Encodes the params as msgpack
+func MarshalMsgpack(params *dynmap.DynMap) ([]byte, error) {
+	var buf bytes.Buffer
+	err := msgpackEncode(&buf, params.Map)
+	return buf.Bytes(), err
+}
+
+// Decodes msgpack params, the top level must be a map
+func UnmarshalMsgpack(data []byte) (*dynmap.DynMap, error) {
+	dec := &msgpackDecoder{data: data}
+	v, err := dec.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if dec.pos != len(data) {
+		return nil, fmt.Errorf("msgpack: %d trailing bytes", len(data)-dec.pos)
+	}
+	mp, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("msgpack: params must be a map, got %T", v)
+	}
+	return &dynmap.DynMap{Map: mp}, nil
+}
+
+func msgpackEncode(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if t {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case string:
+		msgpackWriteLength(buf, len(t), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		buf.WriteString(t)
+	case []byte:
+		msgpackWriteLength(buf, len(t), 0, -1, 0xc4, 0xc5, 0xc6)
+		buf.Write(t)
+	case int:
+		msgpackEncodeInt(buf, int64(t))
+	case int8:
+		msgpackEncodeInt(buf, int64(t))
+	case int16:
+		msgpackEncodeInt(buf, int64(t))
+	case int32:
+		msgpackEncodeInt(buf, int64(t))
+	case int64:
+		msgpackEncodeInt(buf, t)
+	case uint:
+		msgpackEncodeUint(buf, uint64(t))
+	case uint8:
+		msgpackEncodeUint(buf, uint64(t))
+	case uint16:
+		msgpackEncodeUint(buf, uint64(t))
+	case uint32:
+		msgpackEncodeUint(buf, uint64(t))
+	case uint64:
+		msgpackEncodeUint(buf, t)
+	case float32:
+		buf.WriteByte(0xca)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(t))
+	case float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(t))
+	case map[string]interface{}:
+		msgpackWriteLength(buf, len(t), 0x80, 15, 0, 0xde, 0xdf)
+		for k, val := range t {
+			msgpackEncode(buf, k)
+			err := msgpackEncode(buf, val)
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		msgpackWriteLength(buf, len(t), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, val := range t {
+			err := msgpackEncode(buf, val)
+			if err != nil {
+				return err
+			}
+		}
+	case *dynmap.DynMap:
+		if t == nil {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		return msgpackEncode(buf, t.Map)
+	case dynmap.DynMap:
+		return msgpackEncode(buf, t.Map)
+	case dynmap.DynMaper:
+		return msgpackEncode(buf, t.ToDynMap())
+	default:
+		return msgpackEncodeReflect(buf, v)
+	}
+	return nil
+}
+
+// handles typed slices and maps, anything else is encoded as it would be in json
+func msgpackEncodeReflect(buf *bytes.Buffer, v interface{}) error {
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.Ptr:
+		if val.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		if _, ok := v.(json.Marshaler); !ok {
+			return msgpackEncode(buf, val.Elem().Interface())
+		}
+	case reflect.Slice, reflect.Array:
+		if val.Kind() == reflect.Slice && val.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		msgpackWriteLength(buf, val.Len(), 0x90, 15, 0, 0xdc, 0xdd)
+		for i := 0; i < val.Len(); i++ {
+			err := msgpackEncode(buf, val.Index(i).Interface())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		if val.Type().Key().Kind() == reflect.String {
+			msgpackWriteLength(buf, val.Len(), 0x80, 15, 0, 0xde, 0xdf)
+			iter := val.MapRange()
+			for iter.Next() {
+				msgpackEncode(buf, iter.Key().String())
+				err := msgpackEncode(buf, iter.Value().Interface())
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case reflect.String:
+		return msgpackEncode(buf, val.String())
+	}
+
+	//structs, times, ect.
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var generic interface{}
+	err = json.Unmarshal(b, &generic)
+	if err != nil {
+		return err
+	}
+	return msgpackEncode(buf, generic)
+}
+
+// writes the header for a str, bin, array or map of the given length.
+// fixMax is the largest length that fits in the fix type (-1 if there is none)
+// code8 is 0 if there is no 8 bit length type
+func msgpackWriteLength(buf *bytes.Buffer, length int, fix byte, fixMax int, code8, code16, code32 byte) {
+	switch {
+	case length <= fixMax:
+		buf.WriteByte(fix | byte(length))
+	case code8 != 0 && length <= math.MaxUint8:
+		buf.WriteByte(code8)
+		buf.WriteByte(byte(length))
+	case length <= math.MaxUint16:
+		buf.WriteByte(code16)
+		binary.Write(buf, binary.BigEndian, uint16(length))
+	default:
+		buf.WriteByte(code32)
+		binary.Write(buf, binary.BigEndian, uint32(length))
+	}
+}
+
+func msgpackEncodeInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0:
+		msgpackEncodeUint(buf, uint64(i))
+	case i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func msgpackEncodeUint(buf *bytes.Buffer, i uint64) {
+	switch {
+	case i <= 0x7f:
+		buf.WriteByte(byte(i))
+	case i <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(i))
+	case i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(i))
+	case i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(i))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+// the next n bytes, errors if there are not enough
+func (this *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(this.data)-this.pos {
+		return nil, fmt.Errorf("msgpack: unexpected end of data")
+	}
+	b := this.data[this.pos : this.pos+n]
+	this.pos += n
+	return b, nil
+}
+
+// reads an unsigned big endian int of size bytes
+func (this *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := this.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (this *msgpackDecoder) decode(depth int) (interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, fmt.Errorf("msgpack: nested too deep")
+	}
+	b, err := this.next(1)
+	if err != nil {
+		return nil, err
+	}
+	code := b[0]
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code >= 0x80 && code <= 0x8f:
+		return this.decodeMap(int(code&0x0f), depth)
+	case code >= 0x90 && code <= 0x9f:
+		return this.decodeArray(int(code&0x0f), depth)
+	case code >= 0xa0 && code <= 0xbf:
+		return this.decodeString(int(code & 0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		length, err := this.uint(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		bin, err := this.next(int(length))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, bin...), nil
+	case 0xca:
+		i, err := this.uint(4)
+		return float64(math.Float32frombits(uint32(i))), err
+	case 0xcb:
+		i, err := this.uint(8)
+		return math.Float64frombits(i), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		i, err := this.uint(1 << (code - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if i > math.MaxInt64 {
+			return i, nil
+		}
+		return int64(i), nil
+	case 0xd0:
+		i, err := this.uint(1)
+		return int64(int8(i)), err
+	case 0xd1:
+		i, err := this.uint(2)
+		return int64(int16(i)), err
+	case 0xd2:
+		i, err := this.uint(4)
+		return int64(int32(i)), err
+	case 0xd3:
+		i, err := this.uint(8)
+		return int64(i), err
+	case 0xd9, 0xda, 0xdb:
+		length, err := this.uint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return this.decodeString(int(length))
+	case 0xdc, 0xdd:
+		length, err := this.uint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return this.decodeArray(int(length), depth)
+	case 0xde, 0xdf:
+		length, err := this.uint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return this.decodeMap(int(length), depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%x", code)
+}
+
+func (this *msgpackDecoder) decodeString(length int) (interface{}, error) {
+	b, err := this.next(length)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (this *msgpackDecoder) decodeArray(length int, depth int) (interface{}, error) {
+	//every element is at least one byte
+	if length > len(this.data)-this.pos {
+		return nil, fmt.Errorf("msgpack: unexpected end of data")
+	}
+	arr := make([]interface{}, length)
+	for i := 0; i < length; i++ {
+		v, err := this.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = v
+	}
+	return arr, nil
+}
+
+func (this *msgpackDecoder) decodeMap(length int, depth int) (interface{}, error) {
+	//every key and value is at least one byte
+	if length > (len(this.data)-this.pos)/2 {
+		return nil, fmt.Errorf("msgpack: unexpected end of data")
+	}
+	mp := make(map[string]interface{}, length)
+	for i := 0; i < length; i++ {
+		k, err := this.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			key = fmt.Sprintf("%v", k)
+		}
+		v, err := this.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		mp[key] = v
+	}
+	return mp, nil
+}
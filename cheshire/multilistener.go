@@ -0,0 +1,169 @@
+package cheshire
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long a connection to the MultiListen port has to send its
+// first bytes before it is closed.
+var SniffTimeout = 10 * time.Second
+
+// Serves http, json and binary strest on a single port.
+// The first bytes of each connection decide the protocol:
+// an http method token goes to http, '{' goes to json,
+// anything else is treated as the binary hello.
+func MultiListen(port int, config *ServerConfig) error {
+	ln, err := listen(port, config)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer ln.Close()
+	if !config.lifecycle.addListener(ln) {
+		return nil
+	}
+
+	//http connections are handed to the http server through this listener
+	httpLn := newConnListener(ln.Addr())
+	defer httpLn.Close()
+	go func() {
+		err := httpServe(httpLn, config)
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+
+	log.Println("Multi Listener on port: ", port)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if config.lifecycle.stopping() {
+				return nil
+			}
+			log.Print(err)
+			continue
+		}
+		go sniffConnection(conn, httpLn, config)
+	}
+}
+
+// all the http methods that can start a request line
+var httpMethodTokens = [][]byte{
+	[]byte("GET "),
+	[]byte("HEAD "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("PATCH "),
+	[]byte("DELETE "),
+	[]byte("OPTIONS "),
+	[]byte("CONNECT "),
+	[]byte("TRACE "),
+}
+
+// the protocol for a connection starting with these bytes
+func sniffProtocol(peek []byte) string {
+	if len(peek) == 0 {
+		return BIN.Type()
+	}
+	switch peek[0] {
+	case '{', ' ', '\t', '\r', '\n':
+		return JSON.Type()
+	}
+	for _, m := range httpMethodTokens {
+		if bytes.HasPrefix(peek, m) {
+			return "http"
+		}
+	}
+	return BIN.Type()
+}
+
+func sniffConnection(conn net.Conn, httpLn *connListener, config *ServerConfig) {
+	reader := bufio.NewReader(conn)
+	//don't wait forever on connections that never send anything
+	conn.SetReadDeadline(time.Now().Add(SniffTimeout))
+	peek, err := reader.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if peek[0] >= 'A' && peek[0] <= 'Z' {
+		//long enough for the longest method token,
+		//short requests return what is available along with an error
+		peek, _ = reader.Peek(len("OPTIONS "))
+	}
+	conn.SetReadDeadline(time.Time{})
+	pc := &peekedConn{Conn: conn, reader: reader}
+
+	switch sniffProtocol(peek) {
+	case "http":
+		httpLn.push(pc)
+	case JSON.Type():
+		handleJSONConnection(&JsonWriter{serverConfig: config, conn: pc})
+	default:
+		handleConnection(&BinaryWriter{
+			serverConfig: config,
+			conn:         pc,
+			writer:       bufio.NewWriter(pc),
+		})
+	}
+}
+
+// A connection whose first bytes have already been read into the reader
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (this *peekedConn) Read(b []byte) (int, error) {
+	return this.reader.Read(b)
+}
+
+// A net.Listener that accepts connections pushed to it
+type connListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan bool
+	once   sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan bool),
+	}
+}
+
+// hands the connection to Accept, closes it if the listener is closed
+func (this *connListener) push(conn net.Conn) {
+	select {
+	case this.conns <- conn:
+	case <-this.closed:
+		conn.Close()
+	}
+}
+
+func (this *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-this.conns:
+		return conn, nil
+	case <-this.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (this *connListener) Close() error {
+	this.once.Do(func() {
+		close(this.closed)
+	})
+	return nil
+}
+
+func (this *connListener) Addr() net.Addr {
+	return this.addr
+}
@@ -0,0 +1,106 @@
+package cheshire
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/trendrr/goshire/dynmap"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSniffProtocol(t *testing.T) {
+	tests := map[string]string{
+		"GET /ping HTTP/1.1": "http",
+		"OPTIONS ":           "http",
+		"DELETE /x":          "http",
+		`{"strest":{}}`:      "json",
+		"\n{":                "json",
+		"\x00\x00\x02{}":     "bin",
+		"GETTY":              "bin",
+		"":                   "bin",
+	}
+	for peek, expected := range tests {
+		if p := sniffProtocol([]byte(peek)); p != expected {
+			t.Errorf("Expected %q to be %s, got %s", peek, expected, p)
+		}
+	}
+}
+
+func TestMultiListen(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	conf := NewServerConfig()
+	conf.Register([]string{"GET"}, NewController("/ping", []string{"GET"}, PingController))
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	connect := startServer(t, conf, "tcp", addr, func() error {
+		return MultiListen(port, conf)
+	})
+
+	dial := func() net.Conn {
+		conn := connect()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	for _, protocol := range []Protocol{JSON, BIN} {
+		conn := dial()
+		err = protocol.WriteHello(conn, dynmap.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := NewRequest("/ping", "GET")
+		req.SetTxnId("1")
+		_, err = protocol.WriteRequest(req, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := protocol.NewDecoder(bufio.NewReader(conn)).DecodeResponse()
+		if err != nil || res.StatusCode() != 200 {
+			t.Errorf("%s: Expected a ping response, got %v %s", protocol.Type(), res, err)
+		}
+		conn.Close()
+	}
+
+	res, err := http.Get(fmt.Sprintf("http://%s/ping", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 {
+		t.Errorf("Expected a 200 from http, got %d %s", res.StatusCode, body)
+	}
+}
+
+func TestSniffTimeout(t *testing.T) {
+	timeout := SniffTimeout
+	SniffTimeout = 50 * time.Millisecond
+	defer func() { SniffTimeout = timeout }()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan bool)
+	go func() {
+		sniffConnection(server, newConnListener(server.LocalAddr()), NewServerConfig())
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a silent connection to be dropped")
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := client.Read(make([]byte, 1))
+	if err == nil {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
@@ -1,11 +1,13 @@
 package cheshire
 
 import (
+    "bytes"
     "encoding/binary"
     "io"
     "fmt"
     "log"
     "github.com/trendrr/goshire/dynmap"
+    "time"
 )
 
 var TXN_ACCEPT = []string{
@@ -24,6 +26,10 @@ var METHOD = []string{
     "POST", //1
     "PUT", //2
     "DELETE", //3
+    "PATCH", //4
+    "HEAD", //5
+    "OPTIONS", //6
+    CANCEL, //7
 }
 
 var PARAM_ENCODING = []string{
@@ -35,7 +41,7 @@ var CONTENT_ENCODING = []string{
     "string", //0
     "bytes", //1
     "json", //2
-    "msqpack", //3
+    "msgpack", //3
 }
 
 type BinConstants struct {
@@ -72,6 +78,8 @@ func contstantsinit() *BinConstants {
     for i,s := range(CONTENT_ENCODING) {
         c.ContentEncoding[s] = int8(i)
     }
+    //old misspelling
+    c.ContentEncoding["msqpack"] = c.ContentEncoding["msgpack"]
     return c
 }
 
@@ -80,18 +88,32 @@ type BinDecoder struct {
 
     //The fields decoded from the hello
     Hello *dynmap.DynMap
+
+    //packets are framed, see readBinFrame
+    framed bool
+
+    //limits each packet, see SetLimits
+    frame *frameReader
+    limits Limits
+}
+
+// Limits the size of the packets decoded after this
+func (this *BinDecoder) SetLimits(limits Limits) {
+    this.limits = limits
+    this.frame.max = limits.MaxFrameSize
 }
 
 func (this *BinDecoder) DecodeHello() (*dynmap.DynMap, error) {
     log.Println("DECODE HELLO")
-    //read the hello
+    //read the hello, limited to the max frame size
+    this.frame.reset()
     helloEncoding := int8(0)
-    err := binary.Read(this.reader, binary.BigEndian, &helloEncoding)
+    err := binary.Read(this.frame, binary.BigEndian, &helloEncoding)
     if err != nil {
         return nil, err
     }
 
-    hello, err := ReadByteArray(this.reader)
+    hello, err := ReadByteArray(this.frame)
     if err != nil {
         log.Print(err)
         //TODO: Send bad hello.
@@ -105,34 +127,51 @@ func (this *BinDecoder) DecodeHello() (*dynmap.DynMap, error) {
         //TODO: Send bad hello.
         return nil, err
     }
+    this.framed = helloCompression(this.Hello) != "" || helloHeartbeat(this.Hello) > 0
     return this.Hello, nil
+}
+
+// the reader for the next packet, limited to the max frame size
+func (this *BinDecoder) packetReader() (io.Reader, error) {
+    if !this.framed {
+        this.frame.reset()
+        return this.frame, nil
+    }
+    return readBinFrame(this.frame)
 }    
 
     //Decode the next response from the reader
 func (this *BinDecoder) DecodeResponse() (*Response, error) {
-    
-    txnId, err := ReadString(this.reader)
+    reader, err := this.packetReader()
+    if err != nil {
+        return nil, err
+    }
+    return decodeBinResponse(reader, this.limits)
+}
+
+func decodeBinResponse(reader io.Reader, limits Limits) (*Response, error) {
+    txnId, err := ReadString(reader)
     if err != nil {
         return nil, err
     }
 
     // log.Printf("txn %s", txnId)
     txnStatus := int8(0)
-    err = binary.Read(this.reader, binary.BigEndian, &txnStatus)
+    err = binary.Read(reader, binary.BigEndian, &txnStatus)
     if err != nil {
         return nil, err
     }
-    if int(txnStatus) >= len(TXN_STATUS) {
+    if txnStatus < 0 || int(txnStatus) >= len(TXN_STATUS) {
         return nil, fmt.Errorf("TxnStatus too large %d", txnStatus)
     }
 
     statusCode := int16(0)
-    err = binary.Read(this.reader, binary.BigEndian, &statusCode)
+    err = binary.Read(reader, binary.BigEndian, &statusCode)
     if err != nil {
         return nil, err
     }
     // log.Printf("Status %d", statusCode)
-    statusMessage, err := ReadString(this.reader)
+    statusMessage, err := ReadString(reader)
     if err != nil {
         return nil, err
     }
@@ -140,29 +179,18 @@ func (this *BinDecoder) DecodeResponse() (*Response, error) {
 
     //params
     paramEncoding := int8(0)
-    err = binary.Read(this.reader, binary.BigEndian, &paramEncoding)
+    err = binary.Read(reader, binary.BigEndian, &paramEncoding)
     if err != nil {
         return nil, err
     }
-    if int(paramEncoding) >= len(PARAM_ENCODING) {
+    if paramEncoding < 0 || int(paramEncoding) >= len(PARAM_ENCODING) {
         return nil, fmt.Errorf("paramEncoding too large %d", paramEncoding)
     }
 
-    paramsLength := int32(0)
-    err = binary.Read(this.reader, binary.BigEndian, &paramsLength)
+    paramsArray, err := readByteArray32Limited(reader, limits.MaxParamsSize, "params")
     if err != nil {
         return nil, err
     }
-    // log.Printf("contentLentgh %d", contentLength)
-
-    paramsArray := make([]byte, paramsLength)
-    
-    if paramsLength > 0 {
-        _, err = io.ReadAtLeast(this.reader, paramsArray, int(paramsLength))
-        if err != nil {
-            return nil, err
-        }
-    }
 
     params, err := ParseParams(paramEncoding, paramsArray)
     if err != nil {
@@ -172,31 +200,20 @@ func (this *BinDecoder) DecodeResponse() (*Response, error) {
 
 
     contentEncoding := int8(0)
-    err = binary.Read(this.reader, binary.BigEndian, &contentEncoding)
+    err = binary.Read(reader, binary.BigEndian, &contentEncoding)
     if err != nil {
         return nil, err
     }
-    if int(contentEncoding) >= len(CONTENT_ENCODING) {
+    if contentEncoding < 0 || int(contentEncoding) >= len(CONTENT_ENCODING) {
         return nil, fmt.Errorf("contentEncoding too large %d", contentEncoding)
     }
     
     // log.Println(contentEncoding)
 
-    contentLength := int32(0)
-    err = binary.Read(this.reader, binary.BigEndian, &contentLength)
+    content, err := readByteArray32Limited(reader, limits.MaxContentSize, "content")
     if err != nil {
         return nil, err
     }
-    // log.Printf("contentLentgh %d", contentLength)
-
-    content := make([]byte, contentLength)
-    
-    if contentLength > 0 {
-        _, err = io.ReadAtLeast(this.reader, content, int(contentLength))
-        if err != nil {
-            return nil, err
-        }
-    }
     //create the response
 
     response := &Response{
@@ -214,20 +231,24 @@ func (this *BinDecoder) DecodeResponse() (*Response, error) {
 
 // read a shard request from the socket.
 func (this *BinDecoder) DecodeShardRequest() (*ShardRequest, error) {
+    return decodeShardRequest(this.reader)
+}
+
+func decodeShardRequest(reader io.Reader) (*ShardRequest, error) {
     //sharding..
     partition := int16(0)
-    err := binary.Read(this.reader, binary.BigEndian, &partition)
+    err := binary.Read(reader, binary.BigEndian, &partition)
     if err != nil {
         return nil, err
     }
 
-    shardkey, err := ReadString(this.reader)
+    shardkey, err := ReadString(reader)
     if err != nil {
         return nil, err
     }
 
     revision := int64(0)
-    err = binary.Read(this.reader, binary.BigEndian, &revision)
+    err = binary.Read(reader, binary.BigEndian, &revision)
     if err != nil {
         return nil, err
     }
@@ -243,58 +264,65 @@ func (this *BinDecoder) DecodeShardRequest() (*ShardRequest, error) {
 
 //decode the next request from the reader
 func (this *BinDecoder) DecodeRequest() (*Request, error) {
+    reader, err := this.packetReader()
+    if err != nil {
+        return nil, err
+    }
+    return decodeBinRequest(reader, this.limits)
+}
 
+func decodeBinRequest(reader io.Reader, limits Limits) (*Request, error) {
     //shard header
-    shard, err := this.DecodeShardRequest()
+    shard, err := decodeShardRequest(reader)
     if err != nil {
         return nil, err
     }
 
     //txn id
-    txnId, err := ReadString(this.reader)
+    txnId, err := ReadString(reader)
     if err != nil {
         return nil, err
     }
 
     //txn accept
     txnAccept := int8(0)
-    err = binary.Read(this.reader, binary.BigEndian, &txnAccept)
+    err = binary.Read(reader, binary.BigEndian, &txnAccept)
     if err != nil {
         return nil, err
     }
-    if int(txnAccept) >= len(TXN_ACCEPT) {
+    if txnAccept < 0 || int(txnAccept) >= len(TXN_ACCEPT) {
         return nil, fmt.Errorf("TxnAccept too large %d", txnAccept)
     }
 
     //method
     method := int8(0)
-    err = binary.Read(this.reader, binary.BigEndian, &method)
+    err = binary.Read(reader, binary.BigEndian, &method)
     if err != nil {
         return nil, err
     }
-    if int(method) >= len(METHOD) {
+    if method < 0 || int(method) >= len(METHOD) {
         return nil, fmt.Errorf("Method too large %d", method)
     }
 
     //uri
-    uri, err := ReadString(this.reader)
+    uri, err := ReadString(reader)
     if err != nil {
         return nil, err
     }
 
     //params
     paramEncoding := int8(0)
-    err = binary.Read(this.reader, binary.BigEndian, &paramEncoding)
+    err = binary.Read(reader, binary.BigEndian, &paramEncoding)
     if err != nil {
         return nil, err
     }
-    if int(paramEncoding) >= len(PARAM_ENCODING) {
+    if paramEncoding < 0 || int(paramEncoding) >= len(PARAM_ENCODING) {
         return nil, fmt.Errorf("paramEncoding too large %d", paramEncoding)
     }
 
-    paramsArray, err := ReadByteArray32(this.reader)
+    paramsArray, err := readByteArray32Limited(reader, limits.MaxParamsSize, "params")
     if err != nil {
-        return nil, err
+        return nil, limitTxn(err, txnId)
     }
     params, err := ParseParams(paramEncoding, paramsArray)
     if err != nil {
@@ -303,26 +331,18 @@ func (this *BinDecoder) DecodeRequest() (*Request, error) {
     
     //content
     contentEncoding := int8(0)
-    err = binary.Read(this.reader, binary.BigEndian, &contentEncoding)
+    err = binary.Read(reader, binary.BigEndian, &contentEncoding)
     if err != nil {
         return nil, err
     }
-    if int(contentEncoding) >= len(CONTENT_ENCODING) {
+    if contentEncoding < 0 || int(contentEncoding) >= len(CONTENT_ENCODING) {
         return nil, fmt.Errorf("contentEncoding too large %d", contentEncoding)
     }
     // log.Printf("Content encoding %d", contentEncoding)
     
-    contentLength := int32(0)
-    err = binary.Read(this.reader, binary.BigEndian, &contentLength)
+    content, err := readByteArray32Limited(reader, limits.MaxContentSize, "content")
     if err != nil {
-        return nil, err
-    }
-    // log.Printf("Content len %d", contentLength)
-
-    content := make([]byte, contentLength)
-    _, err = io.ReadAtLeast(this.reader, content, int(contentLength))
-    if err != nil {
-        return nil, err
+        return nil, limitTxn(err, txnId)
     }
 
     //create the request
@@ -346,11 +366,23 @@ func ParseParams(paramEncoding int8, params []byte) (*dynmap.DynMap, error) {
         return dynmap.New(), nil
     }
 
-    if paramEncoding == 0 {
-        //json
+    switch paramEncoding {
+    case BINCONST.ParamEncoding["json"]:
         mp := dynmap.New()
         err := mp.UnmarshalJSON(params)
         return mp, err
+    case BINCONST.ParamEncoding["msgpack"]:
+        return UnmarshalMsgpack(params)
+    }
+    return nil, fmt.Errorf("Unsupported param encoding %d", paramEncoding)
+}
+
+func EncodeParams(paramEncoding int8, params *dynmap.DynMap) ([]byte, error) {
+    switch paramEncoding {
+    case BINCONST.ParamEncoding["json"]:
+        return params.MarshalJSON()
+    case BINCONST.ParamEncoding["msgpack"]:
+        return MarshalMsgpack(params)
     }
     return nil, fmt.Errorf("Unsupported param encoding %d", paramEncoding)
 }
@@ -358,13 +390,72 @@ func ParseParams(paramEncoding int8, params []byte) (*dynmap.DynMap, error) {
 
 // Implementation of the binary protocol
 type BinProtocol struct {
+    // How params are encoded when writing, json or msgpack.
+    // defaults to json.  Decoding handles either.
+    ParamEncoding string
+
+    // The compression for the connection (see COMPRESSION), the packets of a compressed
+    // connection are framed so both sides must agree on it in the hello.
+    Compression string
 
+    // How often heartbeats are sent, 0 for none.  The packets are framed
+    // so heartbeats can be told apart, see WriteHeartbeat.
+    Heartbeat time.Duration
 }
 
 var BIN = &BinProtocol{
 
 }
 
+// A binary protocol that writes params with the given encoding
+// (json or msgpack)
+func NewBinProtocol(paramEncoding string) (*BinProtocol, error) {
+    _, ok := BINCONST.ParamEncoding[paramEncoding]
+    if !ok {
+        return nil, fmt.Errorf("Unsupported param encoding %s", paramEncoding)
+    }
+    return &BinProtocol{ParamEncoding: paramEncoding}, nil
+}
+
+// The protocol to respond with, uses the param encoding and compression
+// the client asked for in its hello if they are supported.
+func binProtocolForHello(hello *dynmap.DynMap) *BinProtocol {
+    enc := hello.MustString("param_encoding", "json")
+    compression := helloCompression(hello)
+    heartbeat := helloHeartbeat(hello)
+    if enc == "json" && compression == "" && heartbeat == 0 {
+        return BIN
+    }
+    protocol, err := NewBinProtocol(enc)
+    if err != nil {
+        log.Printf("Client requested %s, using json", err)
+        protocol = &BinProtocol{}
+    }
+    protocol.Compression = compression
+    protocol.Heartbeat = heartbeat
+    return protocol
+}
+
+// are packets framed on this connection, see writeBinFrame
+func (this *BinProtocol) framed() bool {
+    return this.Compression != "" || this.Heartbeat > 0
+}
+
+// Writes a heartbeat frame, heartbeats must have been agreed on in the hello
+func (this *BinProtocol) WriteHeartbeat(writer io.Writer) error {
+    if !this.framed() {
+        return fmt.Errorf("Heartbeats were not negotiated")
+    }
+    return binary.Write(writer, binary.BigEndian, binHeartbeatFrame)
+}
+
+func (this *BinProtocol) paramEncoding() int8 {
+    if this.ParamEncoding == "" {
+        return BINCONST.ParamEncoding["json"]
+    }
+    return BINCONST.ParamEncoding[this.ParamEncoding]
+}
+
 func (this *BinProtocol) Type() string {
     return "bin"
 }
@@ -378,6 +469,16 @@ func (this *BinProtocol) WriteHello(writer io.Writer, hello *dynmap.DynMap) erro
 
     hello.PutIfAbsent("v", StrestVersion)
     hello.PutIfAbsent("useragent", "golang")
+    if this.ParamEncoding != "" {
+        //ask the server to respond in the same encoding
+        hello.PutIfAbsent("param_encoding", this.ParamEncoding)
+    }
+    if this.Compression != "" {
+        hello.PutIfAbsent("compression", this.Compression)
+    }
+    if this.Heartbeat > 0 {
+        hello.PutIfAbsent("heartbeat", int64(this.Heartbeat/time.Millisecond))
+    }
     b, err := hello.MarshalJSON()
     if err != nil {
         return err
@@ -389,6 +490,8 @@ func (this *BinProtocol) WriteHello(writer io.Writer, hello *dynmap.DynMap) erro
 func (this *BinProtocol) NewDecoder(reader io.Reader) Decoder {
     dec := &BinDecoder{
         reader : reader,
+        framed : this.framed(),
+        frame : &frameReader{reader: reader},
     } 
     return dec
 }
@@ -418,6 +521,18 @@ func (this *BinProtocol) WriteShardRequest(s *ShardRequest, writer io.Writer) er
 }
 
 func (this *BinProtocol) WriteResponse(response *Response, writer io.Writer) (int, error) {
+    if !this.framed() {
+        return this.writeResponse(response, writer)
+    }
+    var buf bytes.Buffer
+    n, err := this.writeResponse(response, &buf)
+    if err != nil {
+        return n, err
+    }
+    return n, writeBinFrame(writer, buf.Bytes(), this.Compression != "")
+}
+
+func (this *BinProtocol) writeResponse(response *Response, writer io.Writer) (int, error) {
     //txn id
     _, err := WriteString(writer, response.TxnId())
     if err != nil {
@@ -445,8 +560,8 @@ func (this *BinProtocol) WriteResponse(response *Response, writer io.Writer) (in
     }
 
     //params
-    paramEncoding := int8(0); //json
-    params, err := response.DynMap.MarshalJSON()
+    paramEncoding := this.paramEncoding()
+    params, err := EncodeParams(paramEncoding, &response.DynMap)
     if err != nil {
         return 0, err
     }
@@ -491,7 +606,18 @@ func (this *BinProtocol) WriteResponse(response *Response, writer io.Writer) (in
 
 
 func (this *BinProtocol) WriteRequest(request *Request, writer io.Writer) (int, error) {
-    
+    if !this.framed() {
+        return this.writeRequest(request, writer)
+    }
+    var buf bytes.Buffer
+    n, err := this.writeRequest(request, &buf)
+    if err != nil {
+        return n, err
+    }
+    return n, writeBinFrame(writer, buf.Bytes(), this.Compression != "")
+}
+
+func (this *BinProtocol) writeRequest(request *Request, writer io.Writer) (int, error) {
     err := this.WriteShardRequest(request.Shard, writer)
     if err != nil {
         return 0, err
@@ -528,8 +654,8 @@ func (this *BinProtocol) WriteRequest(request *Request, writer io.Writer) (int,
     }
 
     //params
-    paramEncoding := int8(0); //json
-    params, err := request.Params().MarshalJSON()
+    paramEncoding := this.paramEncoding()
+    params, err := EncodeParams(paramEncoding, request.Params())
     if err != nil {
         return 0, err
     }
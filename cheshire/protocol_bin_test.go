@@ -0,0 +1,152 @@
+package cheshire
+
+import (
+	"bytes"
+	"github.com/trendrr/goshire/dynmap"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// params covering all the msgpack types
+func encodingParams() *dynmap.DynMap {
+	params := dynmap.New()
+	params.Put("string", "hello")
+	params.Put("long_string", string(bytes.Repeat([]byte("a"), 70000)))
+	params.Put("int", 5)
+	params.Put("negative", -100000)
+	params.Put("big", int64(math.MaxInt64))
+	params.Put("float", 1.5)
+	params.Put("bool", true)
+	params.Put("nil", nil)
+	params.Put("list", []interface{}{"a", 1, false})
+	params.Put("strings", []string{"x", "y"})
+	params.PutWithDot("nested.map.value", "deep")
+	return params
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	params := encodingParams()
+	b, err := MarshalMsgpack(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalMsgpack(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.MustString("string", "") != "hello" ||
+		len(decoded.MustString("long_string", "")) != 70000 ||
+		decoded.MustInt("int", 0) != 5 ||
+		decoded.MustInt("negative", 0) != -100000 ||
+		decoded.MustInt64("big", 0) != math.MaxInt64 ||
+		decoded.Map["float"] != 1.5 ||
+		decoded.MustBool("bool", false) != true ||
+		decoded.MustString("nested.map.value", "") != "deep" {
+		t.Errorf("Round trip failed %v", decoded.Map)
+	}
+	if v, ok := decoded.Get("nil"); !ok || v != nil {
+		t.Errorf("Expected nil, got %v", v)
+	}
+	if !reflect.DeepEqual(decoded.Map["list"], []interface{}{"a", int64(1), false}) {
+		t.Errorf("Bad list %v", decoded.Map["list"])
+	}
+	if !reflect.DeepEqual(decoded.Map["strings"], []interface{}{"x", "y"}) {
+		t.Errorf("Bad typed list %v", decoded.Map["strings"])
+	}
+}
+
+func TestMsgpackErrors(t *testing.T) {
+	b, _ := MarshalMsgpack(encodingParams())
+	for i := 0; i < len(b); i += 97 {
+		_, err := UnmarshalMsgpack(b[:i])
+		if err == nil {
+			t.Errorf("Expected an error decoding truncated data at %d", i)
+		}
+	}
+
+	//map claiming 2^32-1 entries
+	_, err := UnmarshalMsgpack([]byte{0xdf, 0xff, 0xff, 0xff, 0xff})
+	if err == nil {
+		t.Errorf("Expected an error for a map longer then the data")
+	}
+
+	//deeply nested arrays
+	deep := append([]byte{0x81, 0xa1, 'a'}, bytes.Repeat([]byte{0x91}, 1000)...)
+	_, err = UnmarshalMsgpack(append(deep, 0xc0))
+	if err == nil {
+		t.Errorf("Expected an error for deeply nested data")
+	}
+
+	_, err = UnmarshalMsgpack([]byte{0x91, 0xc0})
+	if err == nil {
+		t.Errorf("Expected an error for non map params")
+	}
+}
+
+func TestBinProtocolParamEncodings(t *testing.T) {
+	msgpack, err := NewBinProtocol("msgpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewBinProtocol("xml")
+	if err == nil {
+		t.Errorf("Expected an error for an unknown encoding")
+	}
+
+	for _, protocol := range []*BinProtocol{BIN, msgpack} {
+		var buf bytes.Buffer
+		req := NewRequest("/test", "POST")
+		req.SetTxnId("10")
+		req.SetParams(encodingParams())
+		_, err = protocol.WriteRequest(req, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response := NewResponse(NewTxn(req, nil, nil, NewServerConfig()))
+		response.Put("result", []interface{}{"a", "b"})
+		response.PutWithDot("nested.value", 10)
+		_, err = protocol.WriteResponse(response, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dec := protocol.NewDecoder(&buf)
+		decodedReq, err := dec.DecodeRequest()
+		if err != nil {
+			t.Fatalf("%s: %s", protocol.ParamEncoding, err)
+		}
+		if decodedReq.TxnId() != "10" || decodedReq.Uri() != "/test" || decodedReq.Params().MustString("nested.map.value", "") != "deep" {
+			t.Errorf("%s: request round trip failed %v", protocol.ParamEncoding, decodedReq)
+		}
+
+		decodedRes, err := dec.DecodeResponse()
+		if err != nil {
+			t.Fatalf("%s: %s", protocol.ParamEncoding, err)
+		}
+		if decodedRes.TxnId() != "10" || decodedRes.MustInt("nested.value", 0) != 10 || !reflect.DeepEqual(decodedRes.Map["result"], []interface{}{"a", "b"}) {
+			t.Errorf("%s: response round trip failed %v", protocol.ParamEncoding, decodedRes)
+		}
+	}
+}
+
+func TestBinHelloParamEncoding(t *testing.T) {
+	msgpack, _ := NewBinProtocol("msgpack")
+	var buf bytes.Buffer
+	err := msgpack.WriteHello(&buf, dynmap.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello, err := BIN.NewDecoder(&buf).DecodeHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binProtocolForHello(hello).ParamEncoding != "msgpack" {
+		t.Errorf("Expected the server to use msgpack, hello %v", hello)
+	}
+	if binProtocolForHello(dynmap.New()) != BIN {
+		t.Errorf("Expected json by default")
+	}
+}
@@ -1,25 +1,31 @@
 package cheshire
 
 import (
+    "encoding/base64"
     "encoding/json"
     "io"
             "github.com/trendrr/goshire/dynmap"
+    "time"
     // "log"
 )
 
 
 type Protocol interface {
     NewDecoder(io.Reader) Decoder
-    //Say hello on first connection (bin only)
+    //Say hello on first connection
+    //(json only sends a hello if there is something to negotiate)
     WriteHello(io.Writer, *dynmap.DynMap) error
     WriteResponse(*Response, io.Writer) (int, error)
     WriteRequest(*Request, io.Writer) (int, error)
+    //Writes a heartbeat, which the decoder skips.
+    //(binary connections must ask for heartbeats in the hello)
+    WriteHeartbeat(io.Writer) error
     Type() string
 
 }
 
 type Decoder interface {
-    //decode the initial hello (bin only)
+    //decode the initial hello
     DecodeHello() (*dynmap.DynMap, error)
 
     //Decode the next response from the reader
@@ -27,6 +33,10 @@ type Decoder interface {
 
     //decode the next request from the reader
     DecodeRequest() (*Request, error)
+
+    //limits the size of the packets decoded after this,
+    //packets over the limits fail with a *LimitError
+    SetLimits(Limits)
 }
 
 
@@ -35,24 +45,62 @@ type Decoder interface {
 // The JSON protocol implementation
 ///////////////////////
 type JSONProtocol struct {   
+    // The compression for the connection (see COMPRESSION).
+    // large packets are sent as {"strest":{"gzip":"<base64 gzipped packet>"}}
+    Compression string
 
+    // How often heartbeats are sent, 0 for none
+    Heartbeat time.Duration
 }
 
 var JSON = &JSONProtocol{}
 
+// The protocol to respond with, uses the compression and heartbeat the client asked for
+func jsonProtocolForHello(hello *dynmap.DynMap) *JSONProtocol {
+    compression := helloCompression(hello)
+    heartbeat := helloHeartbeat(hello)
+    if compression == "" && heartbeat == 0 {
+        return JSON
+    }
+    return &JSONProtocol{Compression: compression, Heartbeat: heartbeat}
+}
+
 func (this *JSONProtocol) Type() string {
     return "json"
 }
 
 func (this *JSONProtocol) NewDecoder(reader io.Reader) Decoder {
+    frame := &frameReader{reader: reader}
     dec := &JSONDecoder{
-        dec : json.NewDecoder(reader),
+        dec : json.NewDecoder(frame),
+        frame : frame,
     } 
     return dec
 }
 
+// Writes the hello as {"strest":{"hello":{...}}}
+// the hello is optional for json, so nothing is written unless there is something to negotiate.
 func (this *JSONProtocol) WriteHello(writer io.Writer, hello *dynmap.DynMap) error {
-    return nil
+    if this.Compression != "" {
+        hello.PutIfAbsent("compression", this.Compression)
+    }
+    if this.Heartbeat > 0 {
+        hello.PutIfAbsent("heartbeat", int64(this.Heartbeat/time.Millisecond))
+    }
+    if len(hello.Map) == 0 {
+        return nil
+    }
+    hello.PutIfAbsent("v", StrestVersion)
+    hello.PutIfAbsent("useragent", "golang")
+
+    packet := dynmap.New()
+    packet.PutWithDot("strest.hello", hello)
+    b, err := packet.MarshalJSON()
+    if err != nil {
+        return err
+    }
+    _, err = writer.Write(b)
+    return err
 }
 
 func (this *JSONProtocol) WriteResponse(response *Response, writer io.Writer) (int, error) {
@@ -61,29 +109,153 @@ func (this *JSONProtocol) WriteResponse(response *Response, writer io.Writer) (i
         return 0, err
     }
     // log.Printf("JSON %s", string(json))
-    bytes, err := writer.Write(json)
-    return bytes, err
+    return this.writePacket(json, writer)
 }
 func (this *JSONProtocol) WriteRequest(request *Request, writer io.Writer) (int, error) {
     json, err := request.MarshalJSON()
     if err != nil {
         return 0, err
     }
-    bytes, err := writer.Write(json)
-    return bytes, err   
+    return this.writePacket(json, writer)
+}
+
+// Writes {"strest":{"heartbeat":true}}
+func (this *JSONProtocol) WriteHeartbeat(writer io.Writer) error {
+    _, err := writer.Write(jsonHeartbeat)
+    return err
+}
+
+// writes the packet, compressed if it is large enough
+func (this *JSONProtocol) writePacket(packet []byte, writer io.Writer) (int, error) {
+    if this.Compression == "" || len(packet) < CompressionThreshold {
+        return writer.Write(packet)
+    }
+    gz, err := gzipBytes(packet)
+    if err != nil {
+        return 0, err
+    }
+    //base64 encoded by json
+    wrapper := dynmap.New()
+    wrapper.PutWithDot("strest.gzip", gz)
+    b, err := wrapper.MarshalJSON()
+    if err != nil {
+        return 0, err
+    }
+    return writer.Write(b)
 }
 
 type JSONDecoder struct {
     dec *json.Decoder
+    //the first packet, if it was not a hello
+    pending *dynmap.DynMap
+
+    //limits each packet, see SetLimits
+    frame *frameReader
+    limits Limits
+    //the last packet decoded
+    raw []byte
 }
 
+// Limits the size of the packets decoded after this.
+// the params of a json request are part of the packet, so the params limit
+// only applies to packets with room for larger params
+func (this *JSONDecoder) SetLimits(limits Limits) {
+    this.limits = limits
+    this.frame.max = limits.MaxFrameSize
+}
+
+// Decodes the hello, if the client did not send one an empty hello is returned
+// and the first packet is kept for the next decode.
 func (this *JSONDecoder) DecodeHello() (*dynmap.DynMap, error) {
-    return nil, nil
+    mp, err := this.next()
+    if err != nil {
+        return nil, err
+    }
+    hello, ok := mp.GetDynMap("strest.hello")
+    if !ok {
+        this.pending = mp
+        return dynmap.New(), nil
+    }
+    return hello, nil
 }
 
-func (this *JSONDecoder) DecodeResponse() (*Response, error) {
+// decodes the next packet, decompressing it if needed
+// and skipping heartbeats
+func (this *JSONDecoder) next() (*dynmap.DynMap, error) {
+    if this.pending != nil {
+        mp := this.pending
+        this.pending = nil
+        return mp, nil
+    }
+    mp, err := this.decode()
+    for err == nil && mp.MustBool("strest.heartbeat", false) {
+        mp, err = this.decode()
+    }
+    if err != nil {
+        return nil, err
+    }
+    gz, ok := mp.GetString("strest.gzip")
+    if !ok {
+        return mp, nil
+    }
+    compressed, err := base64.StdEncoding.DecodeString(gz)
+    if err != nil {
+        return nil, err
+    }
+    packet, err := gunzipBytes(compressed, this.limits.MaxFrameSize)
+    if err != nil {
+        return nil, err
+    }
+    this.raw = packet
+    mp = dynmap.New()
+    err = mp.UnmarshalJSON(packet)
+    return mp, err
+}
+
+// decodes the next packet from the stream, limited to the max frame size.
+// the json decoder reads ahead, so the bytes read for a packet can include
+// the start of the next one.  the frame reader only bounds the memory used,
+// the decoded packet is measured to enforce the limit.
+func (this *JSONDecoder) decode() (*dynmap.DynMap, error) {
+    this.frame.reset()
+    var raw json.RawMessage
+    err := this.dec.Decode(&raw)
+    if err != nil {
+        return nil, err
+    }
+    if this.frame.max > 0 && int64(len(raw)) > this.frame.max {
+        return nil, &LimitError{What: "frame", Max: this.frame.max}
+    }
+    this.raw = raw
     mp := dynmap.New()
-    err := this.dec.Decode(mp)
+    err = mp.UnmarshalJSON(raw)
+    return mp, err
+}
+
+// fails if the params of the last packet are over the limit.
+// the params are only measured when the whole packet is larger then the limit
+func (this *JSONDecoder) checkParams(txnId string) error {
+    max := this.limits.MaxParamsSize
+    if max <= 0 || int64(len(this.raw)) <= max {
+        return nil
+    }
+    var packet struct {
+        Strest struct {
+            Params json.RawMessage `json:"params"`
+        } `json:"strest"`
+    }
+    err := json.Unmarshal(this.raw, &packet)
+    if err != nil {
+        return err
+    }
+    if int64(len(packet.Strest.Params)) > max {
+        return &LimitError{What: "params", Max: max, txnId: txnId}
+    }
+    return nil
+}
+
+func (this *JSONDecoder) DecodeResponse() (*Response, error) {
+    mp, err := this.next()
     if err != nil {
         return nil, err
     }
@@ -92,11 +264,10 @@ func (this *JSONDecoder) DecodeResponse() (*Response, error) {
 }
 
 func (this *JSONDecoder) DecodeRequest() (*Request, error) {
-    mp := dynmap.New()
-    err := this.dec.Decode(mp)
+    mp, err := this.next()
     if err != nil {
         return nil, err
     }
     req := NewRequestDynMap(mp)
-    return req, nil
+    return req, this.checkParams(req.TxnId())
 }
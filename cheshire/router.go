@@ -1,7 +1,7 @@
 package cheshire
 
 import (
-	"log"
+	"github.com/trendrr/goshire/dynmap"
 	"path"
 	"strings"
 	"sync"
@@ -10,9 +10,12 @@ import (
 // The Cheshire Router, translates between a uri + method to a controller
 type RouteMatcher interface {
 	// A controller matches the given method, path
-	Match(string, string) Controller
+	// Also returns any params captured from the path (nil if none)
+	Match(string, string) (Controller, *dynmap.DynMap)
 	// Registers a controller for the specified methods 
 	Register([]string, Controller)
+	// All the registered routes, sorted by pattern
+	Routes() []RouteInfo
 }
 
 
@@ -29,15 +32,31 @@ type RouteMatcher interface {
 // former will receive requests for any other paths in the
 // "/images/" subtree.
 //
+// Patterns may also contain named params and wildcards, like
+// "/users/:id/posts/:post" or "/files/*rest".  A :param matches
+// a single path segment, a *wildcard matches the remainder of the path
+// and must be the last segment.  The captured values are returned from Match
+// and merged into the request params.  When several patterns match, they are
+// compared segment by segment and the first that differs decides:
+// static beats :param beats a rooted subtree beats *wildcard (see comparePrecedence).
+//
 // Should also takes care of sanitizing the URL request path,
 // redirecting any request containing . or .. elements to an
 // equivalent .- and ..-free URL.
+//
+// If the path matches but no controller is registered for the method
+// a 405 is returned with the allowed methods.  OPTIONS requests are
+// answered automatically and HEAD requests are served by the GET controller.
 type Router struct {
 	mu              sync.RWMutex
 	gets            map[string]muxEntry
+	heads           map[string]muxEntry
 	posts           map[string]muxEntry
 	deletes         map[string]muxEntry
 	puts            map[string]muxEntry
+	patches         map[string]muxEntry
+	options         map[string]muxEntry
+	names           routeNames
 	NotFoundHandler Controller
 }
 
@@ -45,6 +64,9 @@ type muxEntry struct {
 	explicit bool
 	h        Controller
 	pattern  string
+	//the pattern split into segments, only set when the
+	//pattern contains :param or *wildcard segments
+	segments []string
 }
 
 type DefaultNotFoundHandler struct {
@@ -60,13 +82,108 @@ func (h *DefaultNotFoundHandler) HandleRequest(txn *Txn) {
 	txn.Write(response)
 }
 
+// Responds with a 405 for paths that exist but not for the requested method.
+type MethodNotAllowedController struct {
+	// The methods the path is registered for
+	Allow []string
+}
+
+func (h *MethodNotAllowedController) Config() *ControllerConfig {
+	return nil
+}
+func (h *MethodNotAllowedController) HandleRequest(txn *Txn) {
+	response := NewError(txn, 405, "Method Not Allowed")
+	response.Put("allow", h.Allow)
+	setAllowHeader(txn, h.Allow)
+	txn.Write(response)
+}
+
+// Answers OPTIONS requests with the allowed methods for the path
+type OptionsController struct {
+	Allow []string
+}
+
+func (h *OptionsController) Config() *ControllerConfig {
+	return nil
+}
+func (h *OptionsController) HandleRequest(txn *Txn) {
+	response := NewResponse(txn)
+	response.Put("allow", h.Allow)
+	setAllowHeader(txn, h.Allow)
+	txn.Write(response)
+}
+
+// sets the Allow header for http txns.
+func setAllowHeader(txn *Txn, allow []string) {
+	writer, err := ToHttpWriter(txn)
+	if err != nil {
+		//not http
+		return
+	}
+	writer.Writer.Header().Set("Allow", strings.Join(allow, ", "))
+}
+
+// The methods the routers know about, in the order they are listed in the Allow list
+var routeMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// Returns the methods that have a controller for the given path.
+// HEAD is allowed whenever GET is, and OPTIONS is always allowed for existing paths.
+func allowedMethods(path string, match func(string, string) (Controller, *dynmap.DynMap)) []string {
+	found := make(map[string]bool)
+	for _, m := range routeMethods {
+		h, _ := match(m, path)
+		if h != nil {
+			found[m] = true
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	found["OPTIONS"] = true
+	if found["GET"] {
+		found["HEAD"] = true
+	}
+	allow := make([]string, 0, len(found))
+	for _, m := range routeMethods {
+		if found[m] {
+			allow = append(allow, m)
+		}
+	}
+	return allow
+}
+
+// Resolves a request that has no controller registered for its method.
+// HEAD falls back to GET, OPTIONS is answered with the allowed methods and
+// any other method gets a 405 if the path is registered for other methods.
+// returns nil if the path is unknown.
+func methodFallback(method, path string, match func(string, string) (Controller, *dynmap.DynMap)) (Controller, *dynmap.DynMap) {
+	m := strings.ToUpper(method)
+	if m == "HEAD" {
+		h, params := match("GET", path)
+		if h != nil {
+			return h, params
+		}
+	}
+	allow := allowedMethods(path, match)
+	if allow == nil {
+		return nil, nil
+	}
+	if m == "OPTIONS" {
+		return &OptionsController{Allow: allow}, nil
+	}
+	return &MethodNotAllowedController{Allow: allow}, nil
+}
+
 // NewServeMux allocates and returns a new CheshireMux.
 func NewDefaultRouter() *Router {
 	router := &Router{
 		gets:    make(map[string]muxEntry),
+		heads:   make(map[string]muxEntry),
 		posts:   make(map[string]muxEntry),
 		deletes: make(map[string]muxEntry),
 		puts:    make(map[string]muxEntry),
+		patches: make(map[string]muxEntry),
+		options: make(map[string]muxEntry),
 	}
 	router.NotFoundHandler = new(DefaultNotFoundHandler)
 	return router
@@ -85,6 +202,79 @@ func pathMatch(pattern, path string) bool {
 	return len(path) >= n && path[0:n] == pattern
 }
 
+// Does path match the segments of a param pattern?
+// returns the captured params
+func paramMatch(segments []string, path string) (*dynmap.DynMap, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	params := dynmap.New()
+	for i, seg := range segments {
+		if len(seg) > 0 && seg[0] == '*' {
+			if i >= len(parts) {
+				return nil, false
+			}
+			params.Put(seg[1:], strings.Join(parts[i:], "/"))
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		if len(seg) > 0 && seg[0] == ':' {
+			if parts[i] == "" {
+				return nil, false
+			}
+			params.Put(seg[1:], parts[i])
+			continue
+		}
+		if seg != parts[i] {
+			return nil, false
+		}
+	}
+	if len(parts) != len(segments) {
+		return nil, false
+	}
+	return params, true
+}
+
+// splits a pattern into segments if it contains any
+// :param or *wildcard segments, otherwise returns nil
+func patternSegments(pattern string) []string {
+	if !strings.ContainsAny(pattern, ":*") {
+		return nil
+	}
+	segments := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	params := false
+	for i, seg := range segments {
+		if len(seg) == 0 || (seg[0] != ':' && seg[0] != '*') {
+			continue
+		}
+		if len(seg) == 1 {
+			panic("cheshire: unnamed param in pattern " + pattern)
+		}
+		if seg[0] == '*' && i != len(segments)-1 {
+			panic("cheshire: wildcard must be the last segment in pattern " + pattern)
+		}
+		params = true
+	}
+	if !params {
+		return nil
+	}
+	return segments
+}
+
+// The pattern with the names of its params and wildcard dropped.
+// Patterns with the same shape (i.e. "/:a" and "/:b") match exactly the same paths,
+// so both routers refuse to register a second one.
+func patternShape(segments []string) string {
+	shape := make([]string, len(segments))
+	for i, seg := range segments {
+		shape[i] = seg
+		if len(seg) > 0 && (seg[0] == ':' || seg[0] == '*') {
+			shape[i] = seg[:1]
+		}
+	}
+	return "/" + strings.Join(shape, "/")
+}
+
 // Return the canonical path for p, eliminating . and .. elements.
 func cleanPath(p string) string {
 	if p == "" {
@@ -103,50 +293,146 @@ func cleanPath(p string) string {
 }
 
 // Find a handler on a handler map given a path string
-// Most-specific (longest) pattern wins
-func (this *Router) match(method string, path string) Controller {
-	var h Controller
-	var n = 0
+// The pattern with the highest precedence wins, see comparePrecedence
+func (this *Router) match(method string, path string) (Controller, *dynmap.DynMap) {
+	var best *muxEntry
+	var params *dynmap.DynMap
+	var rank []int
 	m, ok := this.getMethodMap(method)
 	if !ok {
-		return nil
+		return nil, nil
+	}
+
+	//exact static matches always win
+	if e, ok := m[path]; ok && e.segments == nil {
+		return e.h, nil
 	}
 
 	for k, v := range m {
-		if !pathMatch(k, path) {
+		var p *dynmap.DynMap
+		if v.segments != nil {
+			p, ok = paramMatch(v.segments, path)
+		} else {
+			ok = pathMatch(k, path)
+		}
+		if !ok {
 			continue
 		}
-		if h == nil || len(k) > n {
-			n = len(k)
-			h = v.h
+		r := patternPrecedence(k, v.segments)
+		if best != nil {
+			c := comparePrecedence(r, rank)
+			//patterns with the same shape are refused on registration, ties are still
+			//decided by the pattern so they can never depend on map order
+			if c > 0 || (c == 0 && k > best.pattern) {
+				continue
+			}
+		}
+		e := v
+		best, params, rank = &e, p, r
+	}
+	if best == nil {
+		return nil, nil
+	}
+	return best.h, params
+}
+
+// The kinds of pattern segment, in order of precedence
+const (
+	staticSegment = iota
+	paramSegment
+	subtreeSegment
+	wildcardSegment
+)
+
+// The kind of each segment of a pattern, for comparing patterns that match the same path.
+// a rooted subtree ("/images/") ends with a subtreeSegment for the rest of the path.
+func patternPrecedence(pattern string, segments []string) []int {
+	if segments == nil {
+		subtree := pattern[len(pattern)-1] == '/'
+		if subtree {
+			pattern = pattern[:len(pattern)-1]
+		}
+		rank := make([]int, 0)
+		if pattern != "" {
+			rank = make([]int, len(splitPath(pattern)))
+		}
+		if subtree {
+			rank = append(rank, subtreeSegment)
+		}
+		return rank
+	}
+	rank := make([]int, len(segments))
+	for i, seg := range segments {
+		switch {
+		case len(seg) > 0 && seg[0] == ':':
+			rank[i] = paramSegment
+		case len(seg) > 0 && seg[0] == '*':
+			rank[i] = wildcardSegment
+		}
+	}
+	return rank
+}
+
+// Compares two patterns that match the same path segment by segment, the first
+// segment that differs decides: static beats :param beats a rooted subtree beats *wildcard.
+// returns < 0 if a has the higher precedence, > 0 if b does.
+// Both routers use this order, i.e. for /a/b/c "/a/b/:y" beats "/a/:x/c" and "/a/b/" beats "/a/*rest"
+func comparePrecedence(a, b []int) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] - b[i]
 		}
 	}
-	return h
+	return len(a) - len(b)
 }
 
 // Match returns the registered Controller that matches the
-// request or, if no match the registered not found handler is returned
-func (mux *Router) Match(method string, path string) (h Controller) {
+// request or, if no match the registered not found handler is returned.
+// params are any values captured by :param or *wildcard segments
+func (mux *Router) Match(method string, path string) (h Controller, params *dynmap.DynMap) {
 	mux.mu.RLock()
 	defer mux.mu.RUnlock()
 
-	h = mux.match(method, path)
+	h, params = mux.match(method, path)
+	if h == nil {
+		h, params = methodFallback(method, path, mux.match)
+	}
 
 	if h == nil {
-		log.Print("Not Found.  TODO: do something!")
 		h = mux.NotFoundHandler
 	}
 	return
 }
 
 // Handle registers the handler for the given pattern.
-// If a handler already exists for pattern, Handle panics.
+// If a handler already exists for pattern, or one that only differs by
+// its param names, Handle panics.
 func (this *Router) Register(methods []string, handler Controller) {
 	this.mu.Lock()
 	defer this.mu.Unlock()
 	for _, m := range methods {
 		this.reg(m, handler)
 	}
+	this.names.add(handler.Config())
+}
+
+func (this *Router) routeNames() *routeNames {
+	return &this.names
+}
+
+// Returns all the registered routes, sorted by pattern
+func (this *Router) Routes() []RouteInfo {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	routes := make([]RouteInfo, 0)
+	for _, method := range routeMethods {
+		m, _ := this.getMethodMap(method)
+		for _, e := range m {
+			routes = append(routes, newRouteInfo(method, e.h))
+		}
+	}
+	sortRoutes(routes)
+	return routes
 }
 
 func (this *Router) getMethodMap(method string) (map[string]muxEntry, bool) {
@@ -154,12 +440,18 @@ func (this *Router) getMethodMap(method string) (map[string]muxEntry, bool) {
 	switch m {
 	case "GET":
 		return this.gets, true
+	case "HEAD":
+		return this.heads, true
 	case "POST":
 		return this.posts, true
 	case "PUT":
 		return this.puts, true
+	case "PATCH":
+		return this.patches, true
 	case "DELETE":
 		return this.deletes, true
+	case "OPTIONS":
+		return this.options, true
 	}
 	return nil, false
 }
@@ -181,6 +473,24 @@ func (this *Router) reg(method string, handler Controller) {
 	if m[pattern].explicit {
 		panic("cheshire: multiple registrations for " + pattern)
 	}
+	segments := patternSegments(pattern)
+	if segments != nil {
+		shape := patternShape(segments)
+		for k, v := range m {
+			if v.segments != nil && patternShape(v.segments) == shape {
+				panic("cheshire: " + pattern + " conflicts with " + k)
+			}
+		}
+	}
 
-	m[pattern] = muxEntry{explicit: true, h: handler, pattern: pattern}
+	m[pattern] = muxEntry{explicit: true, h: handler, pattern: pattern, segments: segments}
+}
+
+// Merges the params captured by the router into the request params.
+// path params take precedence over any params passed in the request.
+func MergeRouteParams(request *Request, params *dynmap.DynMap) {
+	if params == nil {
+		return
+	}
+	request.Params().PutAll(params)
 }
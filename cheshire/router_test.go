@@ -0,0 +1,340 @@
+package cheshire
+
+import (
+	"fmt"
+	"github.com/trendrr/goshire/dynmap"
+	"testing"
+)
+
+func noop(txn *Txn) {}
+
+func testRouter(routes ...string) *Router {
+	router := NewDefaultRouter()
+	register(router, routes...)
+	return router
+}
+
+func register(router RouteMatcher, routes ...string) {
+	for _, r := range routes {
+		router.Register([]string{"GET"}, NewController(r, []string{"GET"}, noop))
+	}
+}
+
+// go test -v github.com/trendrr/goshire/cheshire
+func TestRouterParams(t *testing.T) {
+	testParams(t, NewDefaultRouter())
+}
+
+func TestTrieRouterParams(t *testing.T) {
+	testParams(t, NewTrieRouter())
+}
+
+func TestTrieRouterPrefix(t *testing.T) {
+	router := NewTrieRouter()
+	register(router, "/", "/images/", "/images/thumbnails/", "/images/logo.png")
+
+	tests := map[string]string{
+		"/":                      "/",
+		"/favicon.ico":           "/",
+		"/images":                "/",
+		"/images/":               "/images/",
+		"/images/a.png":          "/images/",
+		"/images/logo.png":       "/images/logo.png",
+		"/images/thumbnails/":    "/images/thumbnails/",
+		"/images/thumbnails/x/y": "/images/thumbnails/",
+	}
+	for path, route := range tests {
+		c, _ := router.Match("GET", path)
+		if c.Config() == nil || c.Config().Route != route {
+			t.Errorf("%s should match %s, got %v", path, route, c.Config())
+		}
+	}
+
+	c, _ := router.Match("POST", "/images/")
+	if _, ok := c.(*MethodNotAllowedController); !ok {
+		t.Errorf("Expected method not allowed for POST")
+	}
+}
+
+func testParams(t *testing.T, router RouteMatcher) {
+	register(router, "/users/:id/posts/:post", "/users/new", "/files/*rest", "/")
+
+	c, params := router.Match("GET", "/users/123/posts/9")
+	if c.Config().Route != "/users/:id/posts/:post" {
+		t.Errorf("Wrong route matched %s", c.Config().Route)
+	}
+	if params.MustString("id", "") != "123" || params.MustString("post", "") != "9" {
+		t.Errorf("Wrong params %s", params)
+	}
+
+	c, params = router.Match("GET", "/files/a/b/c.txt")
+	if c.Config().Route != "/files/*rest" {
+		t.Errorf("Wrong route matched %s", c.Config().Route)
+	}
+	if params.MustString("rest", "") != "a/b/c.txt" {
+		t.Errorf("Wrong wildcard param %s", params)
+	}
+
+	//static match beats params
+	c, params = router.Match("GET", "/users/new")
+	if c.Config().Route != "/users/new" || params != nil {
+		t.Errorf("Static route should win, got %s", c.Config().Route)
+	}
+
+	//not enough segments falls back to the root subtree
+	c, _ = router.Match("GET", "/users/123/posts")
+	if c.Config().Route != "/" {
+		t.Errorf("Expected root subtree, got %s", c.Config().Route)
+	}
+}
+
+func TestRoutePrecedence(t *testing.T) {
+	tests := []struct {
+		path     string
+		patterns []string
+		expected string
+	}{
+		{"/a/b/c", []string{"/a/*rest", "/a/b/"}, "/a/b/"},
+		{"/a/b/c", []string{"/a/:x/c", "/a/b/:y"}, "/a/b/:y"},
+		{"/a/b/c", []string{"/a/:x/c", "/a/b/"}, "/a/b/"},
+		{"/a/b/c", []string{"/a/:x/:y", "/a/*rest"}, "/a/:x/:y"},
+		{"/a/b/c", []string{"/a/:x/c", "/a/:x/:y"}, "/a/:x/c"},
+		{"/a/b", []string{"/a/:x", "/a/b", "/a/"}, "/a/b"},
+		{"/a/b", []string{"/a/:x", "/a/"}, "/a/:x"},
+		{"/a/b", []string{"/a/", "/a/*rest"}, "/a/"},
+		{"/a/b", []string{"/*rest", "/"}, "/"},
+		{"/a/b/", []string{"/a/b/", "/a/b/*rest"}, "/a/b/"},
+		{"/a/b/c/d", []string{"/a/:x/c/", "/a/b/*rest", "/a/"}, "/a/b/*rest"},
+	}
+	for _, test := range tests {
+		//registration order must not matter either
+		for _, reverse := range []bool{false, true} {
+			patterns := make([]string, 0, len(test.patterns))
+			for i := range test.patterns {
+				if reverse {
+					i = len(test.patterns) - 1 - i
+				}
+				patterns = append(patterns, test.patterns[i])
+			}
+			for _, router := range []RouteMatcher{NewDefaultRouter(), NewTrieRouter()} {
+				register(router, patterns...)
+				c, _ := router.Match("GET", test.path)
+				if c.Config() == nil || c.Config().Route != test.expected {
+					t.Errorf("%T: %s with %v should match %s, got %v", router, test.path, patterns, test.expected, c.Config())
+				}
+			}
+		}
+	}
+
+	//patterns that only differ by their param names match the same paths
+	conflicts := [][]string{
+		{"/a/:x", "/a/:y"},
+		{"/a/:x/", "/a/:y/"},
+		{"/a/:x/b", "/a/:y/b"},
+		{"/files/*rest", "/files/*path"},
+	}
+	for _, patterns := range conflicts {
+		for _, router := range []RouteMatcher{NewDefaultRouter(), NewTrieRouter()} {
+			register(router, patterns[0])
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Errorf("%T: expected %s to conflict with %s", router, patterns[1], patterns[0])
+					}
+				}()
+				register(router, patterns[1])
+			}()
+		}
+	}
+}
+
+func TestMergeRouteParams(t *testing.T) {
+	router := testRouter("/users/:id")
+	req := NewRequest("/users/55", "GET")
+	req.Params().Put("id", "bad")
+	req.Params().Put("other", "val")
+
+	_, params := router.Match(req.Method(), req.Uri())
+	MergeRouteParams(req, params)
+	if req.Params().MustString("id", "") != "55" {
+		t.Errorf("Path param should override request param %s", req.Params())
+	}
+	if req.Params().MustString("other", "") != "val" {
+		t.Errorf("Request param was lost %s", req.Params())
+	}
+}
+
+// registers n routes and returns a path that
+// falls in the subtree of one of them
+func benchRoutes(router RouteMatcher, n int) string {
+	for i := 0; i < n; i++ {
+		route := fmt.Sprintf("/v1/resource%d/items", i)
+		if i%2 == 0 {
+			route = fmt.Sprintf("/v1/resource%d/", i)
+		}
+		register(router, route)
+	}
+	return fmt.Sprintf("/v1/resource%d/items/12345", n-2)
+}
+
+func benchmarkMatch(b *testing.B, router RouteMatcher, n int) {
+	path := benchRoutes(router, n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		router.Match("GET", path)
+	}
+}
+
+func BenchmarkRouter10(b *testing.B)       { benchmarkMatch(b, NewDefaultRouter(), 10) }
+func BenchmarkRouter100(b *testing.B)      { benchmarkMatch(b, NewDefaultRouter(), 100) }
+func BenchmarkRouter1000(b *testing.B)     { benchmarkMatch(b, NewDefaultRouter(), 1000) }
+func BenchmarkTrieRouter10(b *testing.B)   { benchmarkMatch(b, NewTrieRouter(), 10) }
+func BenchmarkTrieRouter100(b *testing.B)  { benchmarkMatch(b, NewTrieRouter(), 100) }
+func BenchmarkTrieRouter1000(b *testing.B) { benchmarkMatch(b, NewTrieRouter(), 1000) }
+
+func TestMethodNotAllowed(t *testing.T) {
+	testMethods(t, NewDefaultRouter())
+	testMethods(t, NewTrieRouter())
+}
+
+func testMethods(t *testing.T, router RouteMatcher) {
+	register(router, "/users/:id")
+	router.Register([]string{"PATCH"}, NewController("/users/:id", []string{"PATCH"}, noop))
+
+	c, _ := router.Match("POST", "/users/5")
+	na, ok := c.(*MethodNotAllowedController)
+	if !ok {
+		t.Fatalf("Expected method not allowed, got %v", c)
+	}
+	if fmt.Sprint(na.Allow) != "[GET HEAD PATCH OPTIONS]" {
+		t.Errorf("Wrong allow list %v", na.Allow)
+	}
+
+	c, _ = router.Match("OPTIONS", "/users/5")
+	if _, ok := c.(*OptionsController); !ok {
+		t.Errorf("Expected options controller, got %v", c)
+	}
+
+	c, params := router.Match("HEAD", "/users/5")
+	if c.Config() == nil || c.Config().Route != "/users/:id" || params.MustString("id", "") != "5" {
+		t.Errorf("HEAD should be served by the GET controller, got %v", c)
+	}
+
+	c, _ = router.Match("POST", "/nothing")
+	if _, ok := c.(*DefaultNotFoundHandler); !ok {
+		t.Errorf("Expected not found, got %v", c)
+	}
+}
+
+type namedFilter struct {
+	name string
+}
+
+func (this *namedFilter) Before(txn *Txn) bool {
+	return true
+}
+
+func TestRouteGroup(t *testing.T) {
+	conf := NewServerConfig()
+	auth := &namedFilter{"auth"}
+	audit := &namedFilter{"audit"}
+	own := &namedFilter{"own"}
+
+	admin := conf.Group("/v1/admin/", auth)
+	admin.RegisterApi("/users/:id", "GET", noop)
+	admin.Group("audit", audit).RegisterApi("/log", "get", noop, own)
+
+	c, params := conf.Router.Match("GET", "/v1/admin/users/7")
+	if c.Config() == nil || c.Config().Route != "/v1/admin/users/:id" || params.MustString("id", "") != "7" {
+		t.Errorf("Group route did not match %v", c)
+	}
+	if len(c.Config().Filters) != 1 || c.Config().Filters[0] != auth {
+		t.Errorf("Expected group filter, got %v", c.Config().Filters)
+	}
+
+	c, _ = conf.Router.Match("GET", "/v1/admin/audit/log")
+	if c.Config() == nil || c.Config().Route != "/v1/admin/audit/log" {
+		t.Fatalf("Nested group route did not match %v", c)
+	}
+	f := c.Config().Filters
+	if len(f) != 3 || f[0] != auth || f[1] != audit || f[2] != own {
+		t.Errorf("Wrong filter order %v", f)
+	}
+}
+
+func TestRouteGroupRegisterTwice(t *testing.T) {
+	conf := NewServerConfig()
+	auth := &namedFilter{"auth"}
+	api := conf.Group("/api", auth)
+	controller := NewController("/x", []string{"GET", "POST"}, noop)
+	api.Register([]string{"GET"}, controller)
+	api.Register([]string{"POST"}, controller)
+
+	if controller.Config().Route != "/api/x" {
+		t.Errorf("Expected the prefix once, got %s", controller.Config().Route)
+	}
+	if f := controller.Config().Filters; len(f) != 1 || f[0] != auth {
+		t.Errorf("Expected the group filter once, got %v", f)
+	}
+	for _, method := range []string{"GET", "POST"} {
+		c, _ := conf.Router.Match(method, "/api/x")
+		if c != controller {
+			t.Errorf("%s /api/x did not match", method)
+		}
+	}
+}
+
+func TestRoutesAndURL(t *testing.T) {
+	for _, router := range []RouteMatcher{NewDefaultRouter(), NewTrieRouter()} {
+		conf := NewServerConfig()
+		conf.Router = router
+		users := conf.Group("/users", &namedFilter{"auth"})
+		users.RegisterApi("/:id/files/*path", "GET", noop).Named("file")
+		users.RegisterApi("/", "POST", noop).Named("create")
+		list := users.RegisterApi("/", "GET", noop)
+
+		routes := router.Routes()
+		if len(routes) != 3 {
+			t.Fatalf("Expected 3 routes, got %v", routes)
+		}
+		r := routes[0]
+		if r.Pattern != "/users/" || r.Method != "GET" || r.Controller != "*cheshire.DefaultController" {
+			t.Errorf("Wrong route info %v", r)
+		}
+		if len(r.Filters) != 1 || r.Filters[0] != "*cheshire.namedFilter" {
+			t.Errorf("Wrong filters %v", r.Filters)
+		}
+
+		params := dynmap.New()
+		params.Put("id", 12)
+		params.Put("path", "a b/c.txt")
+		params.Put("v", "2")
+		u, err := conf.URL("file", params)
+		if err != nil || u != "/users/12/files/a%20b/c.txt?v=2" {
+			t.Errorf("Wrong url %s (%s)", u, err)
+		}
+
+		u, err = conf.URL("create", nil)
+		if err != nil || u != "/users/" {
+			t.Errorf("Wrong url %s (%s)", u, err)
+		}
+
+		_, err = conf.URL("file", nil)
+		if err == nil {
+			t.Errorf("Expected missing param error")
+		}
+
+		list.Named("list")
+		urls := namedURLs(router)
+		if len(urls) != 2 || urls["create"] != "/users/" || urls["list"] != "/users/" {
+			t.Errorf("Wrong named urls %v", urls)
+		}
+		list.Named("all")
+		if _, err = conf.URL("list", nil); err == nil {
+			t.Errorf("Expected the old name to be removed")
+		}
+		if u, err = conf.URL("all", nil); err != nil || u != "/users/" {
+			t.Errorf("Wrong url after renaming %s (%s)", u, err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package cheshire
+
+import (
+	"fmt"
+	"github.com/trendrr/goshire/dynmap"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Describes a single registered route.
+type RouteInfo struct {
+	Method  string `json:"method"`
+	Pattern string `json:"pattern"`
+	// The name from the controller config, if any
+	Name       string   `json:"name,omitempty"`
+	Controller string   `json:"controller"`
+	Filters    []string `json:"filters"`
+}
+
+func newRouteInfo(method string, controller Controller) RouteInfo {
+	info := RouteInfo{
+		Method:     method,
+		Controller: fmt.Sprintf("%T", controller),
+		Filters:    make([]string, 0),
+	}
+	conf := controller.Config()
+	if conf != nil {
+		info.Pattern = conf.Route
+		info.Name = conf.Name
+		for _, f := range conf.Filters {
+			info.Filters = append(info.Filters, fmt.Sprintf("%T", f))
+		}
+	}
+	return info
+}
+
+// sorts by pattern, then method
+func sortRoutes(routes []RouteInfo) {
+	order := make(map[string]int)
+	for i, m := range routeMethods {
+		order[m] = i
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Pattern != routes[j].Pattern {
+			return routes[i].Pattern < routes[j].Pattern
+		}
+		return order[routes[i].Method] < order[routes[j].Method]
+	})
+}
+
+// A controller function that lists all the registered routes.
+// Register with the introspection.route config setting, typically /_routes
+func RoutesController(txn *Txn) {
+	response := NewResponse(txn)
+	response.Put("routes", txn.ServerConfig.Router.Routes())
+	txn.Write(response)
+}
+
+// An index of the named routes, updated as controllers are registered
+// or named so building urls doesn't need to go through all the routes.
+// When several controllers share a name the first one registered wins.
+type routeNames struct {
+	lock    sync.RWMutex
+	configs map[string]*ControllerConfig
+	//the patterns of the named routes without params, replaced rather then
+	//updated since it is handed out to the templates
+	urls map[string]string
+}
+
+// implemented by the routers that keep a routeNames index
+type namedRouter interface {
+	routeNames() *routeNames
+}
+
+// adds the controller to the index, called on registration
+func (this *routeNames) add(conf *ControllerConfig) {
+	if conf == nil {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	conf.names = this
+	this.put(conf, "")
+}
+
+// updates the index after the controller was renamed
+func (this *routeNames) rename(conf *ControllerConfig, old string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.put(conf, old)
+}
+
+// must be called with the lock held
+func (this *routeNames) put(conf *ControllerConfig, old string) {
+	if old == "" && conf.Name == "" {
+		return
+	}
+	if this.configs == nil {
+		this.configs = make(map[string]*ControllerConfig)
+	}
+	if old != "" && this.configs[old] == conf {
+		delete(this.configs, old)
+	}
+	if _, ok := this.configs[conf.Name]; !ok && conf.Name != "" {
+		this.configs[conf.Name] = conf
+	}
+	urls := make(map[string]string)
+	for name, c := range this.configs {
+		if patternSegments(c.Route) == nil {
+			urls[name] = c.Route
+		}
+	}
+	this.urls = urls
+}
+
+// the pattern of the named route
+func (this *routeNames) pattern(name string) (string, bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	conf, ok := this.configs[name]
+	if !ok {
+		return "", false
+	}
+	return conf.Route, true
+}
+
+func (this *routeNames) namedURLs() map[string]string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if this.urls == nil {
+		return map[string]string{}
+	}
+	return this.urls
+}
+
+// finds the pattern of the named route, routers that don't
+// index their names are searched through their Routes
+func routePattern(router RouteMatcher, name string) (string, bool) {
+	if r, ok := router.(namedRouter); ok {
+		return r.routeNames().pattern(name)
+	}
+	for _, r := range router.Routes() {
+		if r.Name == name {
+			return r.Pattern, true
+		}
+	}
+	return "", false
+}
+
+// Builds the url for the named route.
+// :param and *wildcard segments are filled in from params,
+// any remaining params are added to the query string.
+// params may be nil
+func RouteURL(router RouteMatcher, name string, params *dynmap.DynMap) (string, error) {
+	pattern, found := routePattern(router, name)
+	if !found {
+		return "", fmt.Errorf("No route named %s", name)
+	}
+
+	remaining := dynmap.New()
+	if params != nil {
+		remaining = params.Clone()
+	}
+
+	u := pattern
+	segments := patternSegments(pattern)
+	if segments != nil {
+		parts := make([]string, len(segments))
+		for i, seg := range segments {
+			if len(seg) == 0 || (seg[0] != ':' && seg[0] != '*') {
+				parts[i] = seg
+				continue
+			}
+			val, ok := remaining.Remove(seg[1:])
+			if !ok {
+				return "", fmt.Errorf("Missing param %s for route %s", seg[1:], name)
+			}
+			str := dynmap.ToString(val)
+			if seg[0] == '*' {
+				//keep the slashes in wildcards
+				sp := strings.Split(str, "/")
+				for j, s := range sp {
+					sp[j] = url.PathEscape(s)
+				}
+				parts[i] = strings.Join(sp, "/")
+			} else {
+				parts[i] = url.PathEscape(str)
+			}
+		}
+		u = "/" + strings.Join(parts, "/")
+	}
+
+	if len(remaining.Map) > 0 {
+		query, err := remaining.MarshalURL()
+		if err != nil {
+			return "", err
+		}
+		u = u + "?" + query
+	}
+	return u, nil
+}
+
+// Returns the urls of all the named routes that have no params.
+// This is added to the html template context as "urls", and must not be modified
+func namedURLs(router RouteMatcher) map[string]string {
+	if r, ok := router.(namedRouter); ok {
+		return r.routeNames().namedURLs()
+	}
+	urls := make(map[string]string)
+	for _, r := range router.Routes() {
+		if r.Name == "" || patternSegments(r.Pattern) != nil {
+			continue
+		}
+		urls[r.Name] = r.Pattern
+	}
+	return urls
+}
@@ -0,0 +1,195 @@
+package cheshire
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long Bootstrap.Close waits for in flight txns
+var DefaultShutdownTimeout = 30 * time.Second
+
+// Tracks the listeners, connections and in flight txns
+// so the server can be shut down cleanly.
+// The zero value is ready to use.
+type lifecycle struct {
+	lock      sync.Mutex
+	stopped   bool
+	listeners map[io.Closer]bool
+	servers   map[*http.Server]bool
+	conns     map[io.Closer]bool
+	txns      map[*Txn]bool
+	//closed once stopped and there are no txns in flight
+	idle chan bool
+}
+
+func (this *lifecycle) init() {
+	if this.listeners == nil {
+		this.listeners = make(map[io.Closer]bool)
+		this.servers = make(map[*http.Server]bool)
+		this.conns = make(map[io.Closer]bool)
+		this.txns = make(map[*Txn]bool)
+	}
+}
+
+func (this *lifecycle) stopping() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.stopped
+}
+
+// adds a listener, returns false if the server is stopping
+func (this *lifecycle) addListener(ln io.Closer) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.init()
+	if this.stopped {
+		return false
+	}
+	this.listeners[ln] = true
+	return true
+}
+
+// adds an http server, returns false if the server is stopping
+func (this *lifecycle) addServer(server *http.Server) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.init()
+	if this.stopped {
+		return false
+	}
+	this.servers[server] = true
+	return true
+}
+
+// adds a connection, returns false if the server is stopping
+func (this *lifecycle) addConn(conn io.Closer) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.init()
+	if this.stopped {
+		return false
+	}
+	this.conns[conn] = true
+	return true
+}
+
+func (this *lifecycle) removeConn(conn io.Closer) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.conns, conn)
+}
+
+// adds an in flight txn, returns false if the server is stopping.
+// the txn is removed once it is released, see Txn.onRelease
+func (this *lifecycle) addTxn(txn *Txn) bool {
+	this.lock.Lock()
+	this.init()
+	if this.stopped {
+		this.lock.Unlock()
+		return false
+	}
+	this.txns[txn] = true
+	this.lock.Unlock()
+	txn.onRelease(func() {
+		this.removeTxn(txn)
+	})
+	return true
+}
+
+func (this *lifecycle) removeTxn(txn *Txn) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.txns, txn)
+	if this.stopped && len(this.txns) == 0 && this.idle != nil {
+		close(this.idle)
+		this.idle = nil
+	}
+}
+
+// Stops accepting new connections and txns, closes the listeners
+// and returns a channel that is closed once no txns are in flight.
+func (this *lifecycle) stop() chan bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.init()
+	idle := make(chan bool)
+	if this.stopped {
+		if this.idle == nil {
+			close(idle)
+			return idle
+		}
+		return this.idle
+	}
+	this.stopped = true
+
+	for ln := range this.listeners {
+		ln.Close()
+	}
+	for server := range this.servers {
+		//stops accepting and closes idle http connections
+		go server.Shutdown(context.Background())
+	}
+
+	if len(this.txns) == 0 {
+		close(idle)
+	} else {
+		this.idle = idle
+	}
+	return idle
+}
+
+// the txns still in flight
+func (this *lifecycle) inflight() []*Txn {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	txns := make([]*Txn, 0, len(this.txns))
+	for txn := range this.txns {
+		txns = append(txns, txn)
+	}
+	return txns
+}
+
+// closes all the connections and http servers
+func (this *lifecycle) closeAll() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for conn := range this.conns {
+		conn.Close()
+	}
+	for server := range this.servers {
+		server.Close()
+	}
+}
+
+// Gracefully shuts down all the listeners using this config.
+// New connections and txns are refused, in flight txns have until
+// ctx is done to complete.  Any txns still open (i.e. streams) are then sent
+// a final completed 503 response and all connections are closed.
+//
+// returns the ctx error if txns had to be closed.
+func (this *ServerConfig) Shutdown(ctx context.Context) error {
+	log.Println("Shutting down, waiting for in flight txns")
+	idle := this.lifecycle.stop()
+
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+		txns := this.lifecycle.inflight()
+		log.Printf("Shutdown timeout, closing %d txns", len(txns))
+		for _, txn := range txns {
+			SendError(txn, 503, "Server shutting down")
+		}
+	}
+
+	if this.cancel != nil {
+		this.cancel()
+	}
+	this.lifecycle.closeAll()
+	return err
+}
@@ -0,0 +1,87 @@
+package cheshire
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShutdownClosesStreams(t *testing.T) {
+	conf := NewServerConfig()
+	writer := &testWriter{}
+
+	started := make(chan bool)
+	controller := NewController("/firehose", []string{"GET"}, func(txn *Txn) {
+		started <- true
+		for txn.Context().Err() == nil {
+			response := NewResponse(txn)
+			response.SetTxnContinue()
+			txn.Write(response)
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+	go HandleRequest(NewRequest("/firehose", "GET"), writer, controller, conf)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := conf.Shutdown(ctx)
+	if err == nil {
+		t.Errorf("Expected a timeout error from shutdown")
+	}
+
+	written := writer.written()
+	last := written[len(written)-1]
+	if !last.TxnComplete() || last.StatusCode() != 503 {
+		t.Errorf("Expected a final completed 503, got %v", last)
+	}
+
+	//new txns are refused
+	HandleRequest(NewRequest("/firehose", "GET"), writer, controller, conf)
+	written = writer.written()
+	if written[len(written)-1].StatusCode() != 503 {
+		t.Errorf("Expected new txns to be refused")
+	}
+}
+
+func TestShutdownAfterSilentHandler(t *testing.T) {
+	conf := NewServerConfig()
+	writer := &testWriter{}
+	//writes nothing
+	controller := NewController("/silent", []string{"GET"}, func(txn *Txn) {})
+	HandleRequest(NewRequest("/silent", "GET"), writer, controller, conf)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := conf.Shutdown(ctx); err != nil {
+		t.Errorf("Expected no in flight txns once the handler returned, got %s", err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("Shutdown waited for a txn whose handler had returned")
+	}
+}
+
+func TestStartPortInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conf := NewServerConfig()
+	conf.Put("ports", map[string]interface{}{"json": ln.Addr().(*net.TCPAddr).Port})
+	done := make(chan error)
+	go func() {
+		done <- NewBootstrap(conf).Start()
+	}()
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Errorf("Expected an error from start")
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Start did not return")
+	}
+}
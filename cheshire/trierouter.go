@@ -0,0 +1,242 @@
+package cheshire
+
+import (
+	"github.com/trendrr/goshire/dynmap"
+	"strings"
+	"sync"
+)
+
+// A RouteMatcher backed by a tree keyed on path segments, so matching
+// is proportional to the depth of the path rather then the number of routes.
+//
+// Accepts the same patterns as Router and keeps the same semantics:
+// fixed paths match exactly, rooted subtrees ("/images/") match any path
+// beneath them.  When several patterns match the same precedence as Router
+// applies, compared segment by segment static beats :param beats a rooted
+// subtree beats *wildcard (see comparePrecedence).
+//
+// Like Router, unregistered methods get a 405, OPTIONS is answered
+// automatically and HEAD is served by the GET controller.
+type TrieRouter struct {
+	mu              sync.RWMutex
+	roots           map[string]*trieNode
+	names           routeNames
+	NotFoundHandler Controller
+}
+
+type trieNode struct {
+	//static segment children
+	children map[string]*trieNode
+	//the :param child, shared by all param names at this position
+	param *trieNode
+
+	//pattern ends at this node
+	exact *muxEntry
+	//rooted subtree pattern ends at this node ("/images/")
+	subtree *muxEntry
+	//*wildcard pattern matching anything below this node
+	wildcard *muxEntry
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{
+		children: make(map[string]*trieNode),
+	}
+}
+
+// Creates a new TrieRouter
+func NewTrieRouter() *TrieRouter {
+	router := &TrieRouter{
+		roots: make(map[string]*trieNode),
+	}
+	for _, m := range routeMethods {
+		router.roots[m] = newTrieNode()
+	}
+	router.NotFoundHandler = new(DefaultNotFoundHandler)
+	return router
+}
+
+// splits a path into its segments, without the leading slash
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+// splits off the next segment of the path.
+// more is false if this was the last segment.
+func nextSegment(path string) (seg string, rest string, more bool) {
+	i := strings.IndexByte(path, '/')
+	if i < 0 {
+		return path, "", false
+	}
+	return path[:i], path[i+1:], true
+}
+
+// finds the entry with the highest precedence matching the remaining path, see
+// comparePrecedence.  At each segment a static child is tried, then the param
+// child, then a subtree or wildcard ending here, so the first match found wins.
+// more is false once there are no segments left
+func (this *trieNode) find(path string, more bool) *muxEntry {
+	if !more {
+		return this.exact
+	}
+	seg, rest, m := nextSegment(path)
+	if c, ok := this.children[seg]; ok {
+		if e := c.find(rest, m); e != nil {
+			return e
+		}
+	}
+	if this.param != nil && seg != "" {
+		if e := this.param.find(rest, m); e != nil {
+			return e
+		}
+	}
+	if this.subtree != nil {
+		return this.subtree
+	}
+	return this.wildcard
+}
+
+func (this *TrieRouter) match(method string, path string) (Controller, *dynmap.DynMap) {
+	root, ok := this.roots[strings.ToUpper(method)]
+	if !ok {
+		return nil, nil
+	}
+	e := root.find(strings.TrimPrefix(path, "/"), true)
+	if e == nil {
+		return nil, nil
+	}
+	if e.segments == nil {
+		return e.h, nil
+	}
+	params, _ := paramMatch(e.segments, path)
+	return e.h, params
+}
+
+// Match returns the registered Controller that matches the
+// request or, if no match the registered not found handler is returned.
+// params are any values captured by :param or *wildcard segments
+func (this *TrieRouter) Match(method string, path string) (h Controller, params *dynmap.DynMap) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	h, params = this.match(method, path)
+	if h == nil {
+		h, params = methodFallback(method, path, this.match)
+	}
+
+	if h == nil {
+		h = this.NotFoundHandler
+	}
+	return
+}
+
+// Registers the handler for the given methods.
+// If a handler already exists for pattern, or one that only differs by
+// its param names, Register panics.
+func (this *TrieRouter) Register(methods []string, handler Controller) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, m := range methods {
+		this.reg(m, handler)
+	}
+	this.names.add(handler.Config())
+}
+
+func (this *TrieRouter) routeNames() *routeNames {
+	return &this.names
+}
+
+// Returns all the registered routes, sorted by pattern
+func (this *TrieRouter) Routes() []RouteInfo {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	routes := make([]RouteInfo, 0)
+	for method, root := range this.roots {
+		routes = root.collect(method, routes)
+	}
+	sortRoutes(routes)
+	return routes
+}
+
+// appends the routes for this node and all its children
+func (this *trieNode) collect(method string, routes []RouteInfo) []RouteInfo {
+	for _, e := range []*muxEntry{this.exact, this.subtree, this.wildcard} {
+		if e != nil {
+			routes = append(routes, newRouteInfo(method, e.h))
+		}
+	}
+	for _, c := range this.children {
+		routes = c.collect(method, routes)
+	}
+	if this.param != nil {
+		routes = this.param.collect(method, routes)
+	}
+	return routes
+}
+
+func (this *TrieRouter) reg(method string, handler Controller) {
+	if handler == nil {
+		panic("cheshire: nil handler")
+	}
+	var pattern = handler.Config().Route
+	root, ok := this.roots[strings.ToUpper(method)]
+	if !ok {
+		panic("cheshire: " + method + " is not a valid method!")
+	}
+	if pattern == "" {
+		panic("cheshire: invalid pattern " + pattern)
+	}
+
+	entry := &muxEntry{explicit: true, h: handler, pattern: pattern, segments: patternSegments(pattern)}
+
+	var parts []string
+	var slot **muxEntry
+	switch {
+	case entry.segments != nil:
+		parts = entry.segments
+	case pattern[len(pattern)-1] == '/':
+		//rooted subtree, drop the empty trailing segment
+		parts = splitPath(pattern[:len(pattern)-1])
+		if pattern == "/" {
+			parts = []string{}
+		}
+	default:
+		parts = splitPath(pattern)
+	}
+
+	node := root
+	for i, seg := range parts {
+		if len(seg) > 0 && seg[0] == '*' && i == len(parts)-1 {
+			slot = &node.wildcard
+			break
+		}
+		if len(seg) > 0 && seg[0] == ':' {
+			if node.param == nil {
+				node.param = newTrieNode()
+			}
+			node = node.param
+			continue
+		}
+		c, ok := node.children[seg]
+		if !ok {
+			c = newTrieNode()
+			node.children[seg] = c
+		}
+		node = c
+	}
+	if slot == nil {
+		if entry.segments == nil && pattern[len(pattern)-1] == '/' {
+			slot = &node.subtree
+		} else {
+			slot = &node.exact
+		}
+	}
+	if *slot != nil && (*slot).pattern == pattern {
+		panic("cheshire: multiple registrations for " + pattern)
+	}
+	if *slot != nil {
+		//only the param names differ, see patternShape
+		panic("cheshire: " + pattern + " conflicts with " + (*slot).pattern)
+	}
+	*slot = entry
+}
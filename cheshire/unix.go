@@ -0,0 +1,29 @@
+package cheshire
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Listens on the unix socket path.
+// A stale socket file left behind by a crashed process is removed,
+// but not one that is still being listened on.
+// Access can be controlled with the permissions of the socket's directory.
+func listenUnix(path string) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	if err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already in use", path)
+		}
+		os.Remove(path)
+	}
+	//the socket file is removed when the listener is closed
+	return net.Listen("unix", path)
+}
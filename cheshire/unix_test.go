@@ -0,0 +1,94 @@
+package cheshire
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Runs listen for the rest of the test and returns a func to dial the server.
+// returns once the listener accepts connections, the server is shut down when the test ends
+func startServer(t *testing.T, conf *ServerConfig, network, addr string, listen func() error) func() net.Conn {
+	t.Helper()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- listen()
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		conf.Shutdown(ctx)
+	})
+
+	dial := func() net.Conn {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		select {
+		case err := <-errs:
+			t.Fatalf("listener on %s stopped: %v", addr, err)
+		default:
+		}
+		conn, err := net.Dial(network, addr)
+		if err == nil {
+			conn.Close()
+			return dial
+		}
+	}
+	t.Fatalf("listener on %s never accepted connections", addr)
+	return nil
+}
+
+// Starts a server on a unix socket in a temp dir, see startServer
+func startUnixServer(t *testing.T, conf *ServerConfig, listen func(string, *ServerConfig) error) func() net.Conn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "server.sock")
+	return startServer(t, conf, "unix", path, func() error {
+		return listen(path, conf)
+	})
+}
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "svc.sock")
+
+	ln, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = listenUnix(path)
+	if err == nil {
+		t.Errorf("Expected an error listening on a socket in use")
+	}
+	ln.Close()
+
+	//stale socket left behind
+	ln, err = net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = listenUnix(path)
+	if err != nil {
+		t.Errorf("Expected stale socket to be replaced, got %s", err)
+	} else {
+		ln.Close()
+	}
+
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, []byte("data"), 0600)
+	_, err = listenUnix(file)
+	if err == nil {
+		t.Errorf("Expected an error listening on a regular file")
+	}
+}
@@ -2,6 +2,9 @@ package cheshire
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
+	"context"
 	"code.google.com/p/go.net/websocket"
 	"io"
 	"log"
@@ -9,8 +12,13 @@ import (
 	"sync"
 )
 
+// The websocket subprotocol for the binary protocol,
+// connections without it use json.
+const WebsocketBinProtocol = "strest-bin"
+
 type WebsocketWriter struct {
 	conn       *websocket.Conn
+	protocol   Protocol
 	writerLock sync.Mutex
 }
 
@@ -18,8 +26,25 @@ func (this *WebsocketWriter) Write(response *Response) (int, error) {
 	defer this.writerLock.Unlock()
 	this.writerLock.Lock()
 
-	bytes, err := JSON.WriteResponse(response, this.conn)
-	return bytes, err
+	//each response is sent as a single frame
+	var buf bytes.Buffer
+	_, err := this.protocol.WriteResponse(response, &buf)
+	if err != nil {
+		return 0, err
+	}
+	return this.conn.Write(buf.Bytes())
+}
+
+func (this *WebsocketWriter) writeHeartbeat() error {
+	defer this.writerLock.Unlock()
+	this.writerLock.Lock()
+	var buf bytes.Buffer
+	err := this.protocol.WriteHeartbeat(&buf)
+	if err != nil {
+		return err
+	}
+	_, err = this.conn.Write(buf.Bytes())
+	return err
 }
 
 func (this *WebsocketWriter) Type() string {
@@ -28,7 +53,7 @@ func (this *WebsocketWriter) Type() string {
 
 type WebsocketController struct {
 	Conf         *ControllerConfig
-	Handler      websocket.Handler
+	Handler      websocket.Server
 	serverConfig *ServerConfig
 }
 
@@ -45,10 +70,45 @@ func NewWebsocketController(route string, config *ServerConfig) *WebsocketContro
 		Conf : NewControllerConfig(route),
 		serverConfig : config,
 	}
-	ws.Handler = websocket.Handler(func(con *websocket.Conn) { ws.HandleWCConnection(con) })
+	ws.Handler = websocket.Server{
+		Handshake: websocketHandshake,
+		Handler:   websocket.Handler(func(con *websocket.Conn) { ws.HandleWCConnection(con) }),
+	}
 	return ws
 }
 
+// Checks the origin (as websocket.Handler does) and selects the
+// binary protocol if the client asked for it.
+func websocketHandshake(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin == nil {
+		return fmt.Errorf("null origin")
+	}
+	config.Origin = origin
+
+	protocol := []string{}
+	for _, p := range config.Protocol {
+		if p == WebsocketBinProtocol {
+			protocol = append(protocol, p)
+		}
+	}
+	config.Protocol = protocol
+	return nil
+}
+
+// The protocol negotiated for the connection
+func websocketProtocol(ws *websocket.Conn) Protocol {
+	for _, p := range ws.Config().Protocol {
+		if p == WebsocketBinProtocol {
+			return BIN
+		}
+	}
+	return JSON
+}
+
 // implements the HttpHijacker interface so we can handle the request directly.
 func (this *WebsocketController) HttpHijack(writer http.ResponseWriter, req *http.Request, serverConfig *ServerConfig) {
 	this.Handler.ServeHTTP(writer, req)
@@ -59,13 +119,41 @@ func (this *WebsocketController) HandleWCConnection(ws *websocket.Conn) {
 	log.Print("CONNECT!")
 
 	defer ws.Close()
+	if !this.serverConfig.lifecycle.addConn(ws) {
+		return
+	}
+	defer this.serverConfig.lifecycle.removeConn(ws)
+
+	//the request context is derived from the server context.
+	//cancelled on disconnect so in flight txns can stop
+	ctx, cancel := context.WithCancel(ws.Request().Context())
+	defer cancel()
+	state := newConnState(this.serverConfig)
 	// log.Print("CONNECT!")
 	// conn.writer = bufio.NewWriter(conn.conn)
 
 
-	// dec := json.NewDecoder(bufio.NewReader(conn.conn))
-	dec := JSON.NewDecoder(bufio.NewReader(ws))
-	writer := &WebsocketWriter{conn: ws}
+	protocol := websocketProtocol(ws)
+	if protocol.Type() == BIN.Type() {
+		ws.PayloadType = websocket.BinaryFrame
+	}
+	writer := &WebsocketWriter{conn: ws, protocol: protocol}
+	dec := protocol.NewDecoder(bufio.NewReader(&IdleReader{Conn: ws, Timeout: this.serverConfig.IdleTimeout}))
+	dec.SetLimits(this.serverConfig.Limits)
+	hello, err := dec.DecodeHello()
+	if err != nil {
+		log.Print(err)
+		writeLimitError(writer, err)
+		return
+	}
+	protocol = NegotiatedProtocol(protocol, hello)
+	err = state.greet(hello, protocol, ws, this.serverConfig)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	writer.protocol = protocol
+	go sendHeartbeats(ctx, writer, helloHeartbeat(hello))
 	for {
 		req, err := dec.DecodeRequest()
 
@@ -74,11 +162,11 @@ func (this *WebsocketController) HandleWCConnection(ws *websocket.Conn) {
 			break
 		} else if err != nil {
 			log.Print(err)
+			writeLimitError(writer, err)
 			break
 		}
 		
-		controller := this.serverConfig.Router.Match(req.Method(), req.Uri())
-		go HandleRequest(req, writer, controller, this.serverConfig)
+		dispatch(ctx, state, req, writer, this.serverConfig)
 	}
 	log.Print("DISCONNECT!")
 }
@@ -0,0 +1,26 @@
+package client
+
+import (
+	"github.com/trendrr/goshire/cheshire"
+	"github.com/trendrr/goshire/dynmap"
+	"time"
+)
+
+// Credentials for servers using a cheshire.ApiKeyAuthenticator
+func ApiKeyCredentials(key string) func() *dynmap.DynMap {
+	return func() *dynmap.DynMap {
+		credentials := dynmap.New()
+		credentials.Put("api_key", key)
+		return credentials
+	}
+}
+
+// Credentials for servers using a cheshire.HmacAuthenticator.
+// a new token is signed for every connection so reconnects don't use expired tokens
+func HmacCredentials(principal string, secret []byte) func() *dynmap.DynMap {
+	return func() *dynmap.DynMap {
+		credentials := dynmap.New()
+		credentials.Put("token", cheshire.NewHmacToken(secret, principal, time.Now()))
+		return credentials
+	}
+}
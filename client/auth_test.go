@@ -0,0 +1,51 @@
+package client
+
+import (
+	"github.com/trendrr/goshire/cheshire"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCredentials(t *testing.T) {
+	secret := []byte("shared")
+	for _, name := range []string{"json", "bin"} {
+		conf := cheshire.NewServerConfig()
+		conf.Authenticator = &cheshire.HmacAuthenticator{Secret: secret, MaxAge: time.Minute}
+		conf.Register([]string{"GET"}, cheshire.NewController("/whoami", []string{"GET"}, func(txn *cheshire.Txn) {
+			response := cheshire.NewResponse(txn)
+			response.Put("principal", txn.Principal.Id)
+			txn.Write(response)
+		}))
+		path, stop := startUnixServer(t, name, conf)
+		newClient := NewJsonUnix
+		if name == "bin" {
+			newClient = NewBinUnix
+		}
+
+		client := newClient(path)
+		client.PoolSize = 1
+		client.Credentials = HmacCredentials("dustin", secret)
+		err := client.Connect()
+		if err != nil {
+			t.Fatalf("%s: error connecting %s", name, err)
+		}
+		res, err := client.ApiCallSync(cheshire.NewRequest("/whoami", "GET"), 5*time.Second)
+		if err != nil || res.MustString("principal", "") != "dustin" {
+			t.Errorf("%s: expected the principal, got %v %s", name, res, err)
+		}
+		client.Close()
+
+		rejected := newClient(path)
+		rejected.PoolSize = 1
+		rejected.Credentials = HmacCredentials("dustin", []byte("wrong"))
+		err = rejected.Connect()
+		if err == nil {
+			rejected.Close()
+		}
+		if err == nil || !strings.Contains(err.Error(), "not authenticated") {
+			t.Errorf("%s: expected the connection to be rejected, got %v", name, err)
+		}
+		stop()
+	}
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"github.com/trendrr/goshire/cheshire"
+	"github.com/trendrr/goshire/dynmap"
+	"testing"
+	"time"
+)
+
+func TestCancel(t *testing.T) {
+	for _, name := range []string{"json", "bin"} {
+		conf := cheshire.NewServerConfig()
+		conf.Register([]string{"GET"}, cheshire.NewController("/ping", []string{"GET"}, cheshire.PingController))
+		conf.Register([]string{"GET"}, cheshire.NewController("/firehose", []string{"GET"}, func(txn *cheshire.Txn) {
+			for txn.Context().Err() == nil {
+				response := cheshire.NewResponse(txn)
+				response.SetTxnContinue()
+				txn.Write(response)
+				time.Sleep(5 * time.Millisecond)
+			}
+		}))
+		path, stop := startUnixServer(t, name, conf)
+		client := NewJsonUnix(path)
+		if name == "bin" {
+			client = NewBinUnix(path)
+		}
+		client.PoolSize = 1
+		client.Negotiate = true
+		err := client.Connect()
+		if err != nil {
+			t.Fatalf("%s: error connecting %s", name, err)
+		}
+
+		req := cheshire.NewRequest("/firehose", "GET")
+		req.SetTxnAccept("multi")
+		responses := make(chan *cheshire.Response, 100)
+		errors := make(chan error, 5)
+		err = client.ApiCall(req, responses, errors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-responses
+		err = client.Cancel(req.TxnId())
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		timeout := time.After(5 * time.Second)
+		for done := false; !done; {
+			select {
+			case res := <-responses:
+				if res.TxnComplete() {
+					if res.StatusCode() != cheshire.CancelledStatus {
+						t.Errorf("%s: expected a cancelled status, got %d", name, res.StatusCode())
+					}
+					done = true
+				}
+			case err := <-errors:
+				t.Fatalf("%s: %s", name, err)
+			case <-timeout:
+				t.Fatalf("%s: txn was not cancelled", name)
+			}
+		}
+		if client.Cancel(req.TxnId()) == nil {
+			t.Errorf("%s: expected an error cancelling a completed txn", name)
+		}
+
+		//the connection is still usable
+		res, err := client.ApiCallSync(cheshire.NewRequest("/ping", "GET"), 5*time.Second)
+		if err != nil || res.StatusCode() != 200 {
+			t.Errorf("%s: expected a ping response, got %v %s", name, res, err)
+		}
+		client.Close()
+		stop()
+	}
+}
+
+func TestCancelClosedConnection(t *testing.T) {
+	hello := dynmap.New()
+	hello.Put("features", []string{"cancel"})
+	//nothing reads the outgoing requests, as when the event loop has stopped
+	conn := &cheshireConn{
+		connected:    1,
+		outgoingChan: make(chan *cheshireRequest),
+		doneChan:     make(chan bool),
+		requests:     map[string]*cheshireRequest{"t1": &cheshireRequest{}},
+		handshake:    cheshire.NewHandshake(hello),
+	}
+	client := &JsonClient{conns: map[*cheshireConn]bool{conn: true}}
+
+	errs := make(chan error)
+	go func() {
+		errs <- client.Cancel("t1")
+	}()
+
+	//the client lock is not held while sending
+	locked := make(chan bool)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		client.connsLock.Lock()
+		client.connsLock.Unlock()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatalf("Cancel held the client lock while sending")
+	}
+
+	close(conn.doneChan)
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Errorf("Expected an error cancelling on a closed connection")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Cancel blocked on a closed connection")
+	}
+}
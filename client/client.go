@@ -2,14 +2,18 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"github.com/trendrr/goshire/cheshire"
 	"github.com/trendrr/goshire/dynmap"
 	"io"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -29,6 +33,17 @@ type Client interface {
 
 type HttpClient struct {
 	Address string
+
+	//connect over https when set.
+	TLSConfig *tls.Config
+
+	//How long ApiCall waits for each response of a txn before
+	//giving up, 0 waits forever.
+	// default is 4 minutes
+	Timeout time.Duration
+
+	client *http.Client
+	once   sync.Once
 }
 
 // does an asynchrounous api call to the requested address.
@@ -44,12 +59,32 @@ func HttpApiCallSync(address string, req *cheshire.Request, timeout time.Duratio
 	return res, err
 }
 
+// Creates a new http client.
+// if the address starts with https:// the default tls config is used
 func NewHttp(address string) *HttpClient {
-	addr := strings.TrimLeft(address, "http://")
+	client := &HttpClient{
+		Timeout: 4 * 60 * time.Second,
+	}
+	if strings.HasPrefix(address, "https://") {
+		client.TLSConfig = &tls.Config{}
+	}
+	addr := strings.TrimPrefix(address, "http://")
+	client.Address = strings.TrimPrefix(addr, "https://")
+	return client
+}
 
-	return &HttpClient{
-		Address: addr,
+func (this *HttpClient) httpClient() *http.Client {
+	if this.TLSConfig == nil {
+		return http.DefaultClient
 	}
+	this.once.Do(func() {
+		this.client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: this.TLSConfig,
+			},
+		}
+	})
+	return this.client
 }
 
 func (this *HttpClient) Close() {
@@ -57,20 +92,76 @@ func (this *HttpClient) Close() {
 }
 
 // Make an async api call
+// The body is decoded as it arrives, so each response of a multi txn
+// is sent to the responseChan as soon as the server writes it.
+// The call ends once a completed response arrives.
 func (this *HttpClient) ApiCall(req *cheshire.Request, responseChan chan *cheshire.Response, errorChan chan error) error {
 	go func() {
-		//TODO we could do something that allows streaming http
-		res, err := this.ApiCallSync(req, 4*60*time.Second)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		//cancels the request if a response takes too long
+		var timer *time.Timer
+		if this.Timeout > 0 {
+			timer = time.AfterFunc(this.Timeout, cancel)
+			defer timer.Stop()
+		}
+
+		res, err := this.do(ctx, req)
 		if err != nil {
-			errorChan <- err
-		} else {
-			responseChan <- res
+			errorChan <- timeoutError(ctx, err)
+			return
+		}
+		defer res.Body.Close()
+
+		dec := json.NewDecoder(res.Body)
+		for {
+			response, err := decodeResponse(dec)
+			if err == io.EOF {
+				err = fmt.Errorf("Connection closed before txn completed")
+			}
+			if err != nil {
+				errorChan <- timeoutError(ctx, err)
+				return
+			}
+			//dont time out waiting on a slow reader
+			if timer != nil && !timer.Stop() {
+				errorChan <- timeoutError(ctx, err)
+				return
+			}
+			responseChan <- response
+			if response.TxnComplete() {
+				return
+			}
+			if timer != nil {
+				timer.Reset(this.Timeout)
+			}
 		}
 	}()
 	return nil
 }
 
+// Does a synchronous api call.  times out after the requested timeout.
+// This will automatically set the txn accept to single
 func (this *HttpClient) ApiCallSync(req *cheshire.Request, timeout time.Duration) (*cheshire.Response, error) {
+	req.SetTxnAccept("single")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	res, err := this.do(ctx, req)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer res.Body.Close()
+	response, err := decodeResponse(json.NewDecoder(res.Body))
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	return response, nil
+}
+
+// sends the request, the txn is cancelled along with ctx
+func (this *HttpClient) do(ctx context.Context, req *cheshire.Request) (*http.Response, error) {
 	uri := req.Uri()
 
 	var reqBody io.Reader
@@ -98,38 +189,53 @@ func (this *HttpClient) ApiCallSync(req *cheshire.Request, timeout time.Duration
 		reqBody = bytes.NewReader(json)
 	}
 
-	url := fmt.Sprintf("http://%s%s", this.Address, uri)
+	scheme := "http"
+	if this.TLSConfig != nil {
+		scheme = "https"
+	}
+	url := fmt.Sprintf("%s://%s%s", scheme, this.Address, uri)
 	//convert to an http.Request
-	request, err := http.NewRequest(req.Method(), url, reqBody)
+	request, err := http.NewRequestWithContext(ctx, req.Method(), url, reqBody)
+	if err != nil {
+		return nil, err
+	}
 
 	if req.Method() != "GET" {
 		//set the content type
 		request.Header.Set("Content-Type", "application/json")
 	}
-
-	if err != nil {
-		return nil, err
+	if req.TxnId() != "" {
+		request.Header.Set("Strest-Txn-Id", req.TxnId())
+	}
+	if req.TxnAccept() != "" {
+		request.Header.Set("Strest-Txn-Accept", req.TxnAccept())
 	}
-	res, err := http.DefaultClient.Do(request)
 
+	return this.httpClient().Do(request)
+}
+
+// decodes the next response from a newline delimited json body
+func decodeResponse(dec *json.Decoder) (*cheshire.Response, error) {
+	var raw json.RawMessage
+	err := dec.Decode(&raw)
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	//convert to a strest response
+	mp := dynmap.New()
+	err = mp.UnmarshalJSON(raw)
 	if err != nil {
 		return nil, err
 	}
+	return cheshire.NewResponseDynMap(mp), nil
+}
 
-	//convert to a strest response2
-	mp := dynmap.New()
-	// var response = &cheshire.Response{*dynmap.NewDynMap()}
-	err = mp.UnmarshalJSON(body)
-	response := cheshire.NewResponseDynMap(mp)
-	if err != nil {
-		return nil, err
+// replaces err with a timeout error if the ctx expired
+func timeoutError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("Request timeout")
 	}
-	return response, nil
+	return err
 }
 
 // Client that utilizes the json protocol and
@@ -138,6 +244,10 @@ func (this *HttpClient) ApiCallSync(req *cheshire.Request, timeout time.Duration
 type JsonClient struct {
 	Host     string
 	Port     int
+	//when set connects to this unix socket rather then Host and Port
+	SocketPath string
+	//when set connects to this websocket url rather then Host and Port
+	WebsocketURL string
 	PingUri  string
 	shutdown int32
 	pool     *Pool
@@ -157,9 +267,45 @@ type JsonClient struct {
 	// default is 500 millis
 	RetryPause time.Duration
 
+	//connect over tls when set.
+	//the ServerName defaults to Host
+	TLSConfig *tls.Config
+
+	//Exchange hellos with the server on each new connection, to agree on the
+	//features both support: cancel, heartbeats, compression, msgpack params and
+	//content streams.  Older servers never reply to the hello, so this is off
+	//by default and must only be turned on for servers that do.
+	//Always on when Credentials are set
+	Negotiate bool
+
+	//How params are encoded by the binary protocol, json (default) or msgpack.
+	//the server is asked to respond with the same encoding in the hello, see Negotiate
+	ParamEncoding string
+
+	//Compress large packets, gzip or none (default).
+	//negotiated with the server in the hello, see Negotiate
+	Compression string
+
+	//How often each connection sends a heartbeat, the server is asked to do the same.
+	//default is 25 seconds, 0 disables heartbeats.  Heartbeats are only sent once the
+	//server agrees to them in its hello (see Negotiate), otherwise PingUri is pinged instead.
+	Heartbeat time.Duration
+
+	//A connection that receives nothing, not even a heartbeat, for this long
+	//is considered dead and is replaced.  default is 3 heartbeats
+	HeartbeatTimeout time.Duration
+
+	//The credentials sent in the hello of each new connection, i.e.
+	//ApiKeyCredentials or HmacCredentials.  see cheshire.ConnectionAuthenticator
+	Credentials func() *dynmap.DynMap
+
 	count          uint64
 	maxInFlightPer int
 	protocol cheshire.Protocol
+
+	//the open connections, to find the one a txn is on
+	conns     map[*cheshireConn]bool
+	connsLock sync.Mutex
 }
 
 //Creates a new Json client
@@ -174,6 +320,7 @@ func NewJson(host string, port int) *JsonClient {
 		MaxInFlight: 200,
 		Retries:     1,
 		RetryPause:  time.Duration(500) * time.Millisecond,
+		Heartbeat:   25 * time.Second,
 		protocol: cheshire.JSON,
 	}
 	return client
@@ -188,6 +335,54 @@ func NewBin(host string, port int) *JsonClient {
 	return client
 }
 
+//Creates a new json client that connects to a unix socket
+// Remember to call client.Connect
+func NewJsonUnix(path string) *JsonClient {
+	client := NewJson("", 0)
+	client.SocketPath = path
+	return client
+}
+
+//Creates a new binary client that connects to a unix socket
+// Remember to call client.Connect
+func NewBinUnix(path string) *JsonClient {
+	client := NewBin("", 0)
+	client.SocketPath = path
+	return client
+}
+
+//Creates a new client that connects to a cheshire websocket
+// i.e. ws://localhost:8010/ws or wss:// for tls
+// Remember to call client.Connect
+func NewWebsocket(url string) *JsonClient {
+	client := NewJson("", 0)
+	client.WebsocketURL = url
+	return client
+}
+
+//Creates a new client that uses the binary protocol over a websocket
+// Remember to call client.Connect
+func NewBinWebsocket(url string) *JsonClient {
+	client := NewWebsocket(url)
+	client.protocol = cheshire.BIN
+	return client
+}
+
+// connects to the server, returns the connection and its address
+func (this *JsonClient) dial() (net.Conn, string, error) {
+	if this.WebsocketURL != "" {
+		conn, err := dialWebsocket(this.WebsocketURL, this.protocol, this.TLSConfig)
+		return conn, this.WebsocketURL, err
+	}
+	if this.SocketPath != "" {
+		conn, err := dial("unix", this.SocketPath, this.TLSConfig)
+		return conn, this.SocketPath, err
+	}
+	addr := fmt.Sprintf("%s:%d", this.Host, this.Port)
+	conn, err := dial("tcp", addr, this.TLSConfig)
+	return conn, addr, err
+}
+
 func (this *JsonClient) setClosed(v bool) {
 	if v {
 		atomic.StoreInt32(&this.shutdown, 1)
@@ -197,7 +392,7 @@ func (this *JsonClient) setClosed(v bool) {
 }
 
 func (this *JsonClient) Closed() bool {
-	return this.shutdown != 0
+	return atomic.LoadInt32(&this.shutdown) != 0
 }
 
 // Starts the json event loop and initializes one or
@@ -207,6 +402,11 @@ func (this *JsonClient) Connect() error {
 	if !this.Closed() {
 		return fmt.Errorf("Connect called on connected client")
 	}
+	protocol, err := this.newProtocol()
+	if err != nil {
+		return err
+	}
+	this.protocol = protocol
 	this.setClosed(false)
 
 	this.maxInFlightPer = int(this.MaxInFlight / this.PoolSize)
@@ -232,6 +432,43 @@ func (this *JsonClient) Connect() error {
 	return nil
 }
 
+// how long a connection can go without receiving anything
+func (this *JsonClient) heartbeatTimeout() time.Duration {
+	if this.Heartbeat <= 0 {
+		return 0
+	}
+	if this.HeartbeatTimeout > 0 {
+		return this.HeartbeatTimeout
+	}
+	return 3 * this.Heartbeat
+}
+
+// the protocol for new connections, with the configured
+// param encoding, compression and heartbeat
+func (this *JsonClient) newProtocol() (cheshire.Protocol, error) {
+	if !cheshire.SupportedCompression(this.Compression) {
+		return nil, fmt.Errorf("Unsupported compression %s", this.Compression)
+	}
+	heartbeat := this.Heartbeat
+	if heartbeat < 0 {
+		heartbeat = 0
+	}
+	if this.protocol.Type() == cheshire.JSON.Type() {
+		return &cheshire.JSONProtocol{Compression: this.Compression, Heartbeat: heartbeat}, nil
+	}
+	enc := this.ParamEncoding
+	if enc == "" {
+		enc = "json"
+	}
+	protocol, err := cheshire.NewBinProtocol(enc)
+	if err != nil {
+		return nil, err
+	}
+	protocol.Compression = this.Compression
+	protocol.Heartbeat = heartbeat
+	return protocol, nil
+}
+
 //Close this client.
 func (this *JsonClient) Close() {
 	if this.Closed() {
@@ -248,6 +485,7 @@ func (this *JsonClient) Close() {
 // This will attempt to return the next operating connection
 func (this *JsonClient) connection() (*cheshireConn, error) {
 	var err error
+	replaced := 0
 	for x := 0; x < this.Retries; x++ {
 		for i := 0; i < this.PoolSize; i++ {
 			c, err := this.pool.Borrow(1 * time.Second)
@@ -255,6 +493,16 @@ func (this *JsonClient) connection() (*cheshireConn, error) {
 				log.Printf("Error getting connection from pool : %s", err)
 				continue
 			}
+			if !c.Connected() {
+				//i.e. heartbeats stopped, replace it.
+				//the replacement goes to the back of the pool so doesn't count as an attempt
+				this.pool.ReturnBroken(c)
+				if replaced < this.PoolSize {
+					replaced++
+					i--
+				}
+				continue
+			}
 			return c, nil
 		}
 		if x < this.Retries {
@@ -268,10 +516,25 @@ func (this *JsonClient) connection() (*cheshireConn, error) {
 
 }
 
+// are any of the connections without heartbeats, so need pinging
+func (this *JsonClient) needsPing() bool {
+	this.connsLock.Lock()
+	defer this.connsLock.Unlock()
+	for conn, _ := range this.conns {
+		if conn.heartbeat <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (this *JsonClient) pingLoop() {
 	pingTimer := time.Tick(25 * time.Second)
 	for !this.Closed() {
 		<-pingTimer
+		if !this.needsPing() {
+			continue
+		}
 		for i := 0; i < this.PoolSize; i++ {
 			//Do the ping
 			_, err := this.doApiCallSync(cheshire.NewRequest(this.PingUri, "GET"), 10*time.Second)
@@ -282,6 +545,26 @@ func (this *JsonClient) pingLoop() {
 	}
 }
 
+// Cancels an in flight txn, i.e. a multi txn that is no longer wanted.
+// The server stops the txn and sends a final completed response with
+// status cheshire.CancelledStatus, which closes out the txn as usual.
+// Other txns on the connection are unaffected.
+func (this *JsonClient) Cancel(txnId string) error {
+	var found *cheshireConn
+	this.connsLock.Lock()
+	for conn, _ := range this.conns {
+		if conn.Connected() && conn.inflightTxn(txnId) {
+			found = conn
+			break
+		}
+	}
+	this.connsLock.Unlock()
+	if found == nil {
+		return fmt.Errorf("Txn %s is not in flight", txnId)
+	}
+	return found.cancel(txnId)
+}
+
 // Does a synchronous api call.  times out after the requested timeout.
 // This will automatically set the txn accept to single
 func (this *JsonClient) ApiCallSync(req *cheshire.Request, timeout time.Duration) (*cheshire.Response, error) {
@@ -341,6 +624,18 @@ func (this *JsonClient) doApiCall(req *cheshire.Request, responseChan chan *ches
 	return r, err
 }
 
+// the hello for a new connection, with fresh credentials
+func (this *JsonClient) hello() *dynmap.DynMap {
+	hello := dynmap.New()
+	if this.Negotiate || this.Credentials != nil {
+		hello.Put("features", cheshire.Features)
+	}
+	if this.Credentials != nil {
+		hello.Put("auth", this.Credentials())
+	}
+	return hello
+}
+
 //handles the creation for the pool
 type clientPoolCreator struct {
 	client *JsonClient
@@ -349,17 +644,33 @@ type clientPoolCreator struct {
 //Should create and connect to a new client
 func (this *clientPoolCreator) Create() (*cheshireConn, error) {
 	log.Printf("Max Inflight %d, Per %d, Poolsize %d", this.client.MaxInFlight, this.client.maxInFlightPer, this.client.PoolSize)
-	c, err := newCheshireConn(this.client.protocol, fmt.Sprintf("%s:%d", this.client.Host, this.client.Port), 20*time.Second, this.client.maxInFlightPer)
+	conn, addr, err := this.client.dial()
 	if err != nil {
 		return nil, err
 	}
+	c, err := newCheshireConn(this.client.protocol, this.client.hello(), conn, addr, 20*time.Second, this.client.maxInFlightPer)
+	if err != nil {
+		return nil, err
+	}
+	if c.heartbeat > 0 {
+		c.readTimeout = this.client.heartbeatTimeout()
+	}
 	
 	go c.eventLoop()
+	this.client.connsLock.Lock()
+	if this.client.conns == nil {
+		this.client.conns = make(map[*cheshireConn]bool)
+	}
+	this.client.conns[c] = true
+	this.client.connsLock.Unlock()
 	return c, nil
 }
 
 //Should clean up the connection resources
 //implementation should deal with Cleanup possibly being called multiple times
 func (this *clientPoolCreator) Cleanup(conn *cheshireConn) {
+	this.client.connsLock.Lock()
+	delete(this.client.conns, conn)
+	this.client.connsLock.Unlock()
 	conn.Close()
 }
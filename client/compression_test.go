@@ -0,0 +1,50 @@
+package client
+
+import (
+	"github.com/trendrr/goshire/cheshire"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompression(t *testing.T) {
+	large := strings.Repeat("compress", cheshire.CompressionThreshold)
+	for _, name := range []string{"json", "bin"} {
+		conf := cheshire.NewServerConfig()
+		conf.Register([]string{"POST"}, cheshire.NewController("/echo", []string{"POST"}, func(txn *cheshire.Txn) {
+			response := cheshire.NewResponse(txn)
+			response.Put("echo", txn.Params().MustString("value", ""))
+			txn.Write(response)
+		}))
+		path, stop := startUnixServer(t, name, conf)
+		client := NewJsonUnix(path)
+		if name == "bin" {
+			client = NewBinUnix(path)
+		}
+
+		client.Compression = "gzip"
+		client.PoolSize = 1
+		client.Negotiate = true
+		err := client.Connect()
+		if err != nil {
+			t.Fatalf("%s: error connecting %s", name, err)
+		}
+		for _, value := range []string{"small", large} {
+			req := cheshire.NewRequest("/echo", "POST")
+			req.Params().Put("value", value)
+			res, err := client.ApiCallSync(req, 5*time.Second)
+			if err != nil || res.MustString("echo", "") != value {
+				t.Errorf("%s: expected the value echoed, got %s", name, err)
+			}
+		}
+		client.Close()
+		stop()
+	}
+
+	client := NewJsonUnix(filepath.Join(t.TempDir(), "none.sock"))
+	client.Compression = "lz4"
+	if client.Connect() == nil {
+		t.Errorf("Expected an error for unsupported compression")
+	}
+}
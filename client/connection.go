@@ -2,6 +2,8 @@ package client
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
 	// "encoding/json"
 	"fmt"
 	"github.com/trendrr/goshire/cheshire"
@@ -25,9 +27,10 @@ type cheshireConn struct {
 	connected    int32
 	readTimeout  time.Duration
 	writeTimeout time.Duration
-	incomingChan chan *cheshire.Response
 	outgoingChan chan *cheshireRequest
 	exitChan     chan int
+	//closed once the event loop has stopped
+	doneChan chan bool
 	//every new request will push a bool into this chan,
 	//it will block once full
 	inflightChan chan bool
@@ -39,6 +42,14 @@ type cheshireConn struct {
 	connectedAt time.Time
 	maxInFlight int
 	protocol cheshire.Protocol
+	//how often to send a heartbeat, 0 for none
+	heartbeat time.Duration
+
+	//what the server agreed to in the hello
+	handshake *cheshire.Handshake
+	//decodes the responses, the servers hello has already been read
+	decoder cheshire.Decoder
+	reader  *cheshire.IdleReader
 }
 
 //wrap a request so we dont lose track of the result channels
@@ -46,17 +57,93 @@ type cheshireRequest struct {
 	req        *cheshire.Request
 	resultChan chan *cheshire.Response
 	errorChan  chan error
+
+	//responses waiting for a slow reader, see deliver
+	queue      []*cheshire.Response
+	queueLock  sync.Mutex
+	delivering bool
+	//signaled when drain makes room in the queue
+	room chan bool
 }
 
-func newCheshireConn(protocol cheshire.Protocol, addr string, writeTimeout time.Duration, maxInFlight int) (*cheshireConn, error) {
-	conn, err := net.DialTimeout("tcp", addr, time.Second)
-	if err != nil {
-		return nil, err
+// Sends the response to the result channel.  if the reader is behind, up to
+// ContentStreamBuffer responses queue up for this txn and are sent in order
+// from another routine.  Once the queue is full this blocks until there is
+// room, so the connection stops being read until the reader catches up.
+// returns false if done is closed first.
+func (this *cheshireRequest) deliver(response *cheshire.Response, done chan bool) bool {
+	this.queueLock.Lock()
+	defer this.queueLock.Unlock()
+	for len(this.queue) > 0 && len(this.queue) >= ContentStreamBuffer {
+		this.queueLock.Unlock()
+		select {
+		case <-this.room:
+		case <-done:
+			this.queueLock.Lock()
+			return false
+		}
+		this.queueLock.Lock()
+	}
+	//the queue may have been drained while waiting
+	if !this.delivering {
+		select {
+		case this.resultChan <- response:
+			return true
+		default:
+		}
+		this.delivering = true
+		if this.room == nil {
+			this.room = make(chan bool, 1)
+		}
+		go this.drain()
 	}
+	this.queue = append(this.queue, response)
+	return true
+}
 
-	err = protocol.WriteHello(conn, dynmap.New())
+func (this *cheshireRequest) drain() {
+	for {
+		this.queueLock.Lock()
+		if len(this.queue) == 0 {
+			this.delivering = false
+			this.queueLock.Unlock()
+			return
+		}
+		response := this.queue[0]
+		this.queue = this.queue[1:]
+		this.queueLock.Unlock()
+		this.resultChan <- response
+		select {
+		case this.room <- true:
+		default:
+		}
+	}
+}
+
+// dials the address (tcp or unix), using tls if tlsConfig is not nil
+func dial(network, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	if tlsConfig == nil {
+		return net.DialTimeout(network, addr, time.Second)
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, network, addr, tlsConfig)
+}
+
+// How long to wait for the servers hello, when negotiating (see JsonClient.Negotiate)
+var HandshakeTimeout = 5 * time.Second
+
+// wraps a newly dialed connection, exchanging hellos with the server.
+// the connection uses the settings and features the server agreed to.
+func newCheshireConn(protocol cheshire.Protocol, hello *dynmap.DynMap, conn net.Conn, addr string, writeTimeout time.Duration, maxInFlight int) (*cheshireConn, error) {
+	reader := &cheshire.IdleReader{Conn: conn}
+	protocol, decoder, reply, err := handshake(protocol, hello, conn, reader)
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return nil, fmt.Errorf("Error in hello with %s: %s", addr, err)
+	}
+	handshake := cheshire.NewHandshake(reply)
+	heartbeat := time.Duration(0)
+	if handshake.Supports("heartbeat") {
+		heartbeat = time.Duration(reply.MustInt64("heartbeat", 0)) * time.Millisecond
 	}
 
 	nc := &cheshireConn{
@@ -65,7 +152,7 @@ func newCheshireConn(protocol cheshire.Protocol, addr string, writeTimeout time.
 		addr:         addr,
 		writeTimeout: writeTimeout,
 		exitChan:     make(chan int),
-		incomingChan: make(chan *cheshire.Response, 25),
+		doneChan:     make(chan bool),
 		outgoingChan: make(chan *cheshireRequest, 25),
 
 		inflightChan:  make(chan bool, maxInFlight),
@@ -73,10 +160,55 @@ func newCheshireConn(protocol cheshire.Protocol, addr string, writeTimeout time.
 		connectedAt: time.Now(),
 		protocol: protocol,
 		maxInFlight : maxInFlight,
+		heartbeat: heartbeat,
+		handshake: handshake,
+		decoder: decoder,
+		reader: reader,
 	}
 	return nc, nil
 }
 
+// sends our hello and, if it lists our features, reads the servers.
+// returns the protocol the server agreed to and the decoder to read the responses with.
+// Without features the server sends no reply (older servers never do), so no features are used.
+// Older json servers answer the hello with a 404 rather then a hello, then too the
+// server is assumed to have no features.  No hello within the HandshakeTimeout is an error.
+func handshake(protocol cheshire.Protocol, hello *dynmap.DynMap, conn net.Conn, reader io.Reader) (cheshire.Protocol, cheshire.Decoder, *dynmap.DynMap, error) {
+	_, negotiate := hello.Get("features")
+	if !negotiate {
+		//nothing is asked of the server, so nothing it can't do is written
+		protocol = cheshire.NegotiatedProtocol(protocol, dynmap.New())
+	}
+	//written in a single write so it is one websocket frame
+	var buf bytes.Buffer
+	err := protocol.WriteHello(&buf, hello)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	decoder := protocol.NewDecoder(bufio.NewReader(reader))
+	if !negotiate {
+		return protocol, decoder, dynmap.New(), nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	reply, err := decoder.DecodeHello()
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return nil, nil, nil, fmt.Errorf("No hello from the server within %s, it may be too old to negotiate", HandshakeTimeout)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	//an empty reply was not a hello, the decoder keeps the packet for the responses
+	if reply.MustInt("status", 200) == cheshire.UnauthorizedStatus {
+		return nil, nil, nil, fmt.Errorf("Connection not authenticated: %s", reply.MustString("status_message", ""))
+	}
+	return cheshire.NegotiatedProtocol(protocol, reply), decoder, reply, conn.SetReadDeadline(time.Time{})
+}
+
 func (this *cheshireConn) setConnected(v bool) {
 	if v {
 		atomic.StoreInt32(&this.connected, 1)
@@ -86,7 +218,7 @@ func (this *cheshireConn) setConnected(v bool) {
 }
 
 func (this *cheshireConn) Connected() bool {
-	return this.connected == 1
+	return atomic.LoadInt32(&this.connected) == 1
 }
 
 //returns the current # of requests in flight
@@ -125,6 +257,30 @@ func (this *cheshireConn) sendRequest(request *cheshire.Request, resultChan chan
 	return req, nil
 }
 
+// is the txn in flight on this connection
+func (this *cheshireConn) inflightTxn(txnId string) bool {
+	this.requestsLock.RLock()
+	defer this.requestsLock.RUnlock()
+	_, ok := this.requests[txnId]
+	return ok
+}
+
+// Sends a cancel for a txn in flight on this connection.
+// the server responds with a final completed response on the txn.
+func (this *cheshireConn) cancel(txnId string) error {
+	if !this.handshake.Supports("cancel") {
+		return fmt.Errorf("Server does not support cancel")
+	}
+	req := cheshire.NewRequest("", cheshire.CANCEL)
+	req.SetTxnId(txnId)
+	select {
+	case this.outgoingChan <- &cheshireRequest{req: req}:
+		return nil
+	case <-this.doneChan:
+		return fmt.Errorf("Connection is closed %s", this.addr)
+	}
+}
+
 func (this *cheshireConn) Close() {
 	if !this.Connected() {
 		return //do nothing.
@@ -138,7 +294,9 @@ func (this *cheshireConn) String() string {
 
 // loop that listens for incoming messages.
 func (this *cheshireConn) listener() {
-	decoder := this.protocol.NewDecoder(bufio.NewReader(this.Conn))
+	//the read fails if the server stops sending heartbeats
+	this.reader.Timeout = this.readTimeout
+	decoder := this.decoder
 	log.Printf("Starting Cheshire Connection %s", this.addr)
 	defer func() { this.exitChan <- 1 }()
 	for {
@@ -150,11 +308,38 @@ func (this *cheshireConn) listener() {
 			log.Print(err)
 			break
 		}
-		this.incomingChan <- res
+		if !this.receive(res) {
+			break
+		}
 	}
 }
 
+// hands the response to its txn, waiting while the txn has no room.
+// returns false if the connection closed while waiting
+func (this *cheshireConn) receive(response *cheshire.Response) bool {
+	this.requestsLock.RLock()
+	req, ok := this.requests[response.TxnId()]
+	this.requestsLock.RUnlock()
+	if !ok {
+		log.Printf("Uhh, received response, but had no request %v", response)
+		return true
+	}
+	if !req.deliver(response, this.doneChan) {
+		return false
+	}
+	//remove if txn is finished..
+	if response.TxnStatus() == "completed" {
+		this.requestsLock.Lock()
+		delete(this.requests, response.TxnId())
+		this.requestsLock.Unlock()
+		//pull one from inflight
+		<-this.inflightChan
+	}
+	return true
+}
+
 func (this *cheshireConn) cleanup() {
+	close(this.doneChan)
 	this.Conn.Close()
 	log.Printf("Closing Cheshire Connection: %s", this.addr)
 
@@ -163,7 +348,9 @@ func (this *cheshireConn) cleanup() {
 	for len(this.outgoingChan) > 0 {
 		req := <-this.outgoingChan
 		//send an error to the error chan
-		req.errorChan <- err
+		if req.errorChan != nil {
+			req.errorChan <- err
+		}
 	}
 	log.Println("ended outchan")
 	this.requestsLock.Lock()
@@ -178,41 +365,45 @@ func (this *cheshireConn) cleanup() {
 func (this *cheshireConn) eventLoop() {
 	go this.listener()
 
-	// writer := bufio.NewWriter(this.Conn)
+	//each request is buffered and sent in a single write
+	var buf bytes.Buffer
+
+	var heartbeats <-chan time.Time
+	if this.heartbeat > 0 {
+		ticker := time.NewTicker(this.heartbeat)
+		defer ticker.Stop()
+		heartbeats = ticker.C
+	}
 
 	defer this.cleanup()
 	for this.Connected() {
 		select {
-		case response := <-this.incomingChan:
-			this.requestsLock.RLock()
-			req, ok := this.requests[response.TxnId()]
-			this.requestsLock.RUnlock()
-			if !ok {
-				log.Printf("Uhh, received response, but had no request %s", response)
-				// for k,_ := range(this.requests) {
-				//     log.Println(k)
-				// }
-				continue //break?
+		case <-heartbeats:
+			this.SetWriteDeadline(time.Now().Add(this.writeTimeout))
+			buf.Reset()
+			err := this.protocol.WriteHeartbeat(&buf)
+			if err == nil {
+				_, err = this.Conn.Write(buf.Bytes())
+			}
+			if err != nil {
+				log.Print(err)
 			}
-			req.resultChan <- response
-			//remove if txn is finished..
-			if response.TxnStatus() == "completed" {
+		case request := <-this.outgoingChan:
+			//add to the request map, cancels respond on the original txn
+			if request.req.Method() != cheshire.CANCEL {
 				this.requestsLock.Lock()
-				delete(this.requests, response.TxnId())
+				this.requests[request.req.TxnId()] = request
 				this.requestsLock.Unlock()
-				//pull one from inflight
-				<- this.inflightChan
 			}
-		case request := <-this.outgoingChan:
-			//add to the request map
-			this.requestsLock.Lock()
-			this.requests[request.req.TxnId()] = request
-			this.requestsLock.Unlock()
 
 			//send the request
 			this.SetWriteDeadline(time.Now().Add(this.writeTimeout))
 
-			_, err := this.protocol.WriteRequest(request.req, this.Conn)
+			buf.Reset()
+			_, err := this.protocol.WriteRequest(request.req, &buf)
+			if err == nil {
+				_, err = this.Conn.Write(buf.Bytes())
+			}
 			if err != nil {
 				//TODO: uhh, do something..
 				log.Print(err)
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"fmt"
+	"github.com/trendrr/goshire/cheshire"
+	"io"
+)
+
+// How many content chunks are buffered for the reader.  Any txn can also queue
+// this many responses its reader has not taken yet, past that the connection
+// stops being read (holding up its other txns) until the reader catches up.
+var ContentStreamBuffer = 16
+
+// Requests content streamed with cheshire.SendContentStream (binary protocol only).
+// The content is read chunk by chunk, it is never held in memory all at once.
+// Close before the end cancels the txn.
+func (this *JsonClient) ContentStream(req *cheshire.Request) (io.ReadCloser, error) {
+	req.SetTxnAccept("multi")
+	reader := &contentReader{
+		client:    this,
+		responses: make(chan *cheshire.Response, ContentStreamBuffer),
+		errors:    make(chan error, 5),
+	}
+	_, err := this.doApiCall(req, reader.responses, reader.errors)
+	if err != nil {
+		return nil, err
+	}
+	reader.txnId = req.TxnId()
+	return reader, nil
+}
+
+type contentReader struct {
+	client    *JsonClient
+	txnId     string
+	responses chan *cheshire.Response
+	errors    chan error
+	//the rest of the current chunk
+	chunk []byte
+	//set once the txn is completed
+	done bool
+	err  error
+}
+
+func (this *contentReader) Read(p []byte) (int, error) {
+	for len(this.chunk) == 0 {
+		if this.done {
+			return 0, this.err
+		}
+		this.next()
+	}
+	n := copy(p, this.chunk)
+	this.chunk = this.chunk[n:]
+	return n, nil
+}
+
+// waits for the next response
+func (this *contentReader) next() {
+	select {
+	case response := <-this.responses:
+		this.chunk, _ = response.Content()
+		if response.TxnComplete() {
+			this.done = true
+			this.err = io.EOF
+			if response.StatusCode() != 200 {
+				this.err = fmt.Errorf("Content stream failed: %d %s", response.StatusCode(), response.StatusMessage())
+			}
+		}
+	case err := <-this.errors:
+		this.done = true
+		this.err = err
+	}
+}
+
+// Cancels the txn if it is not complete.  The remaining responses
+// are discarded so the connection is not blocked.
+func (this *contentReader) Close() error {
+	if this.done {
+		return nil
+	}
+	this.done = true
+	this.err = fmt.Errorf("Content stream closed")
+	go func() {
+		for {
+			select {
+			case response := <-this.responses:
+				if response.TxnComplete() {
+					return
+				}
+			case <-this.errors:
+				return
+			}
+		}
+	}()
+	this.client.Cancel(this.txnId)
+	return nil
+}
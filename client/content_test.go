@@ -0,0 +1,127 @@
+package client
+
+import (
+	"bytes"
+	"github.com/trendrr/goshire/cheshire"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestContentStream(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), cheshire.ContentChunkSize)
+	conf := cheshire.NewServerConfig()
+	conf.Register([]string{"GET"}, cheshire.NewController("/download", []string{"GET"}, func(txn *cheshire.Txn) {
+		cheshire.SendContentStream(txn, "bytes", bytes.NewReader(content))
+	}))
+	cancelled := make(chan bool, 1)
+	conf.Register([]string{"GET"}, cheshire.NewController("/endless", []string{"GET"}, func(txn *cheshire.Txn) {
+		//never ends unless cancelled
+		err := cheshire.SendContentStream(txn, "bytes", &endlessReader{})
+		if err != nil && txn.Context().Err() != nil {
+			cancelled <- true
+		}
+	}))
+	path, _ := startUnixServer(t, "bin", conf)
+
+	client := NewBinUnix(path)
+	client.PoolSize = 1
+	client.Negotiate = true
+	err := client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	reader, err := client.ContentStream(cheshire.NewRequest("/download", "GET"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := ioutil.ReadAll(reader)
+	if err != nil || !bytes.Equal(received, content) {
+		t.Errorf("Expected the content, got %d bytes %s", len(received), err)
+	}
+	reader.Close()
+
+	reader, err = client.ContentStream(cheshire.NewRequest("/endless", "GET"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(reader, make([]byte, 3*cheshire.ContentChunkSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected closing the reader to cancel the txn")
+	}
+
+	//the connection is still usable
+	reader, _ = client.ContentStream(cheshire.NewRequest("/download", "GET"))
+	received, _ = ioutil.ReadAll(reader)
+	if len(received) != len(content) {
+		t.Errorf("Expected the content after a cancel, got %d bytes", len(received))
+	}
+}
+
+func TestContentStreamSlowReader(t *testing.T) {
+	//more chunks then the reader and connection buffer
+	content := bytes.Repeat([]byte("0"), 60*cheshire.ContentChunkSize)
+	conf := cheshire.NewServerConfig()
+	conf.Register([]string{"GET"}, cheshire.NewController("/download", []string{"GET"}, func(txn *cheshire.Txn) {
+		cheshire.SendContentStream(txn, "bytes", bytes.NewReader(content))
+	}))
+	conf.Register([]string{"GET"}, cheshire.NewController("/ping", []string{"GET"}, cheshire.PingController))
+	path, _ := startUnixServer(t, "bin", conf)
+
+	client := NewBinUnix(path)
+	client.PoolSize = 1
+	client.Negotiate = true
+	err := client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	reader, err := client.ContentStream(cheshire.NewRequest("/download", "GET"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//nothing is read for a while, the connection stops being read once
+	//the txn has buffered and queued all it may
+	time.Sleep(200 * time.Millisecond)
+	txnId := reader.(*contentReader).txnId
+	conn := onlyConn(t, client)
+	conn.requestsLock.RLock()
+	req := conn.requests[txnId]
+	conn.requestsLock.RUnlock()
+	if req == nil {
+		t.Fatalf("Expected the txn to still be in flight")
+	}
+	req.queueLock.Lock()
+	queued := len(req.queue)
+	req.queueLock.Unlock()
+	buffered := len(reader.(*contentReader).responses)
+	if queued > ContentStreamBuffer || buffered > ContentStreamBuffer {
+		t.Errorf("Expected at most %d chunks buffered and queued, got %d and %d", ContentStreamBuffer, buffered, queued)
+	}
+
+	received, err := ioutil.ReadAll(reader)
+	if err != nil || !bytes.Equal(received, content) {
+		t.Errorf("Expected the content, got %d bytes %s", len(received), err)
+	}
+	//once caught up the connection is read again
+	res, err := client.ApiCallSync(cheshire.NewRequest("/ping", "GET"), 2*time.Second)
+	if err != nil || res.StatusCode() != 200 {
+		t.Errorf("Expected a response after the reader caught up, got %v %s", res, err)
+	}
+}
+
+type endlessReader struct{}
+
+func (this *endlessReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
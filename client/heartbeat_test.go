@@ -0,0 +1,148 @@
+package client
+
+import (
+	"github.com/trendrr/goshire/cheshire"
+	"github.com/trendrr/goshire/dynmap"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the only connection in the client pool
+func onlyConn(t *testing.T, client *JsonClient) *cheshireConn {
+	client.connsLock.Lock()
+	defer client.connsLock.Unlock()
+	if len(client.conns) != 1 {
+		t.Fatalf("Expected 1 connection, got %d", len(client.conns))
+	}
+	for conn, _ := range client.conns {
+		return conn
+	}
+	return nil
+}
+
+func TestHeartbeat(t *testing.T) {
+	for _, name := range []string{"json", "bin"} {
+		conf := cheshire.NewServerConfig()
+		conf.IdleTimeout = 100 * time.Millisecond
+		conf.Register([]string{"GET"}, cheshire.NewController("/ping", []string{"GET"}, cheshire.PingController))
+		path, stop := startUnixServer(t, name, conf)
+		client := NewJsonUnix(path)
+		if name == "bin" {
+			client = NewBinUnix(path)
+		}
+
+		client.PoolSize = 1
+		client.Negotiate = true
+		client.Heartbeat = 20 * time.Millisecond
+		err := client.Connect()
+		if err != nil {
+			t.Fatalf("%s: error connecting %s", name, err)
+		}
+		conn := onlyConn(t, client)
+
+		//idle for longer then the server and client timeouts
+		time.Sleep(300 * time.Millisecond)
+		res, err := client.ApiCallSync(cheshire.NewRequest("/ping", "GET"), 5*time.Second)
+		if err != nil || res.StatusCode() != 200 {
+			t.Errorf("%s: expected a ping response, got %v %s", name, res, err)
+		}
+		if !conn.Connected() || onlyConn(t, client) != conn {
+			t.Errorf("%s: expected heartbeats to keep the connection open", name)
+		}
+		if client.needsPing() {
+			t.Errorf("%s: expected no pings once the server agreed to heartbeats", name)
+		}
+		client.Close()
+		stop()
+	}
+}
+
+func TestHeartbeatNotAgreed(t *testing.T) {
+	conf := cheshire.NewServerConfig()
+	conf.Register([]string{"GET"}, cheshire.NewController("/ping", []string{"GET"}, cheshire.PingController))
+	path, stop := startUnixServer(t, "bin", conf)
+	defer stop()
+
+	//without negotiating the server is never asked to agree
+	client := NewBinUnix(path)
+	client.PoolSize = 1
+	client.Heartbeat = 10 * time.Millisecond
+	err := client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn := onlyConn(t, client)
+	if conn.heartbeat != 0 || conn.readTimeout != 0 || conn.protocol.(*cheshire.BinProtocol).Heartbeat != 0 {
+		t.Errorf("Expected no heartbeats or framing without the servers agreement")
+	}
+	if !client.needsPing() {
+		t.Errorf("Expected connections without heartbeats to be pinged")
+	}
+
+	//idle past the heartbeat, the connection must still work
+	time.Sleep(50 * time.Millisecond)
+	res, err := client.ApiCallSync(cheshire.NewRequest("/ping", "GET"), 5*time.Second)
+	if err != nil || res.StatusCode() != 200 {
+		t.Errorf("Expected a response, got %v %s", res, err)
+	}
+}
+
+func TestHeartbeatDeadPeer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	//accepts connections and replies to the hello, but never responds after that
+	accepted := int32(0)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			defer conn.Close()
+			hello := dynmap.New()
+			hello.Put("features", []string{"heartbeat"})
+			hello.Put("heartbeat", 10)
+			cheshire.JSON.WriteHello(conn, hello)
+		}
+	}()
+
+	client := NewJsonUnix(path)
+	client.PoolSize = 1
+	client.Negotiate = true
+	client.Heartbeat = 10 * time.Millisecond
+	client.HeartbeatTimeout = 50 * time.Millisecond
+	err = client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	dead := onlyConn(t, client)
+
+	time.Sleep(200 * time.Millisecond)
+	if dead.Connected() {
+		t.Fatalf("Expected the connection to be marked broken")
+	}
+	conn, err := client.connection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.pool.Return(conn)
+	if conn == dead || !conn.Connected() {
+		t.Errorf("Expected the pool to replace the dead connection")
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&accepted) != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&accepted) != 2 {
+		t.Errorf("Expected a new connection, got %d", atomic.LoadInt32(&accepted))
+	}
+}
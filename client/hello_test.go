@@ -0,0 +1,147 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/trendrr/goshire/cheshire"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	for _, name := range []string{"json", "bin"} {
+		conf := cheshire.NewServerConfig()
+		conf.Register([]string{"GET"}, cheshire.NewController("/handshake", []string{"GET"}, func(txn *cheshire.Txn) {
+			response := cheshire.NewResponse(txn)
+			response.Put("useragent", txn.Handshake.UserAgent)
+			response.Put("cancel", txn.Handshake.Supports("cancel"))
+			txn.Write(response)
+		}))
+		path, stop := startUnixServer(t, name, conf)
+		client := NewJsonUnix(path)
+		if name == "bin" {
+			client = NewBinUnix(path)
+		}
+		client.PoolSize = 1
+		client.Negotiate = true
+		err := client.Connect()
+		if err != nil {
+			t.Fatalf("%s: error connecting %s", name, err)
+		}
+		conn := onlyConn(t, client)
+		if !conn.handshake.Supports("cancel") || !conn.handshake.Supports("heartbeat") || conn.handshake.UserAgent != "goshire" {
+			t.Errorf("%s: expected the server features, got %v", name, conn.handshake)
+		}
+
+		res, err := client.ApiCallSync(cheshire.NewRequest("/handshake", "GET"), 5*time.Second)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if res.MustString("useragent", "") != "golang" || !res.MustBool("cancel", false) {
+			t.Errorf("%s: expected the controller to see the handshake, got %v", name, res)
+		}
+		client.Close()
+		stop()
+	}
+}
+
+// serves like a server from before the hello reply.  A bin server reads the
+// hello and never replies to it, a json server decodes the hello as a request
+// and answers it like any unknown uri, with a 404.  Packets are never framed.
+func serveOldServer(ln net.Listener, name string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			protocol := cheshire.Protocol(cheshire.JSON)
+			if name == "bin" {
+				protocol = cheshire.BIN
+				encoding := int8(0)
+				if binary.Read(reader, binary.BigEndian, &encoding) != nil {
+					return
+				}
+				if _, err := cheshire.ReadByteArray(reader); err != nil {
+					return
+				}
+			}
+			decoder := protocol.NewDecoder(reader)
+			for {
+				req, err := decoder.DecodeRequest()
+				if err != nil {
+					return
+				}
+				response := cheshire.NewResponse(req)
+				if req.Uri() != "/ping" {
+					response = cheshire.NewError(req, 404, "Not Found")
+				}
+				_, err = protocol.WriteResponse(response, conn)
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestHandshakeOldServer(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"json", "bin"} {
+		path := filepath.Join(dir, name+".sock")
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go serveOldServer(ln, name)
+
+		for _, negotiate := range []bool{false, true} {
+			if name == "bin" && negotiate {
+				//never replies, covered below
+				continue
+			}
+			client := NewJsonUnix(path)
+			if name == "bin" {
+				client = NewBinUnix(path)
+			}
+			//the defaults ask for heartbeats, which the server never agrees to
+			client.PoolSize = 1
+			client.Negotiate = negotiate
+			start := time.Now()
+			err = client.Connect()
+			if err != nil {
+				t.Fatalf("%s: error connecting %s", name, err)
+			}
+			if time.Since(start) > time.Second {
+				t.Errorf("%s: expected to connect without waiting for a hello, took %s", name, time.Since(start))
+			}
+			conn := onlyConn(t, client)
+			if len(conn.handshake.Features) != 0 || conn.heartbeat != 0 {
+				t.Errorf("%s: expected a server without features, got %v", name, conn.handshake)
+			}
+			res, err := client.ApiCallSync(cheshire.NewRequest("/ping", "GET"), 5*time.Second)
+			if err != nil || res.StatusCode() != 200 {
+				t.Errorf("%s: expected a response, got %v %s", name, res, err)
+			}
+			client.Close()
+		}
+	}
+
+	//an old bin server never replies, negotiating with it fails
+	timeout := HandshakeTimeout
+	HandshakeTimeout = 50 * time.Millisecond
+	defer func() { HandshakeTimeout = timeout }()
+	client := NewBinUnix(filepath.Join(dir, "bin.sock"))
+	client.PoolSize = 1
+	client.Negotiate = true
+	err := client.Connect()
+	if err == nil {
+		client.Close()
+		t.Errorf("Expected negotiating with an old bin server to fail")
+	}
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/trendrr/goshire/cheshire"
+	"net"
+	"testing"
+	"time"
+)
+
+// starts an http server with a stream that sends count responses, pause apart
+func startHttpStream(t *testing.T, count int, pause time.Duration) *HttpClient {
+	conf := cheshire.NewServerConfig()
+	controller := cheshire.NewController("/stream", []string{"GET"}, func(txn *cheshire.Txn) {
+		for i := 0; i < count; i++ {
+			time.Sleep(pause)
+			response := cheshire.NewResponse(txn)
+			response.Put("index", i)
+			if i < count-1 {
+				response.SetTxnContinue()
+			}
+			txn.Write(response)
+		}
+	})
+	controller.Config().Timeout = -1
+	conf.Register([]string{"GET"}, controller)
+
+	port := freePort(t)
+	go cheshire.HttpListen(port, conf)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		conf.Shutdown(ctx)
+	})
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	for i := 0; i < 100; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return NewHttp(addr)
+}
+
+func TestHttpStream(t *testing.T) {
+	client := startHttpStream(t, 3, 20*time.Millisecond)
+
+	responseChan := make(chan *cheshire.Response)
+	errorChan := make(chan error, 1)
+	req := cheshire.NewRequest("/stream", "GET")
+	req.SetTxnAccept("multi")
+	client.ApiCall(req, responseChan, errorChan)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case res := <-responseChan:
+			if res.MustInt("index", -1) != i {
+				t.Errorf("Expected response %d, got %v", i, res)
+			}
+			if res.TxnComplete() != (i == 2) {
+				t.Errorf("Expected only the last response to be completed, got %s", res.TxnStatus())
+			}
+		case err := <-errorChan:
+			t.Fatalf("Unexpected error %s", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for response %d", i)
+		}
+	}
+	select {
+	case res := <-responseChan:
+		t.Errorf("Unexpected response after completed %v", res)
+	case err := <-errorChan:
+		t.Errorf("Unexpected error after completed %s", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHttpStreamTimeout(t *testing.T) {
+	client := startHttpStream(t, 3, 200*time.Millisecond)
+	client.Timeout = 50 * time.Millisecond
+
+	responseChan := make(chan *cheshire.Response)
+	errorChan := make(chan error, 1)
+	req := cheshire.NewRequest("/stream", "GET")
+	req.SetTxnAccept("multi")
+	client.ApiCall(req, responseChan, errorChan)
+	select {
+	case res := <-responseChan:
+		t.Errorf("Expected a timeout, got %v", res)
+	case err := <-errorChan:
+		if err.Error() != "Request timeout" {
+			t.Errorf("Expected a timeout, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout was not applied")
+	}
+
+	_, err := client.ApiCallSync(cheshire.NewRequest("/stream", "GET"), 50*time.Millisecond)
+	if err == nil {
+		t.Errorf("Expected a timeout from ApiCallSync")
+	}
+}
@@ -0,0 +1,237 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/trendrr/goshire/cheshire"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// a self signed ca, and server and client certs signed by it.
+type testCerts struct {
+	dir  string
+	pool *x509.CertPool
+	//client cert for mutual tls
+	client tls.Certificate
+}
+
+func (this *testCerts) path(name string) string {
+	return filepath.Join(this.dir, name)
+}
+
+// creates a cert signed by parent (or self signed if parent is nil)
+// writes name.crt and name.key to the dir
+func writeCert(t *testing.T, dir, name string, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent = tmpl
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err = os.WriteFile(filepath.Join(dir, name+".crt"), certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, name+".key"), keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, pair
+}
+
+func newTestCerts(t *testing.T) *testCerts {
+	dir := t.TempDir()
+	now := time.Now()
+	ca, caKey, _ := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}, ca, caKey)
+
+	_, _, client := writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return &testCerts{dir: dir, pool: pool, client: client}
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// starts a tls server with the ping controller on the given listener
+func startTLSServer(t *testing.T, tlsConf *tls.Config, listen func(int, *cheshire.ServerConfig) error) (*cheshire.ServerConfig, int) {
+	conf := cheshire.NewServerConfig()
+	conf.TLS = tlsConf
+	conf.Register([]string{"GET"}, cheshire.NewController("/ping", []string{"GET"}, cheshire.PingController))
+	port := freePort(t)
+	go listen(port, conf)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		conf.Shutdown(ctx)
+	})
+
+	//wait for the listener
+	for i := 0; i < 100; i++ {
+		c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err == nil {
+			c.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return conf, port
+}
+
+func TestTLSJsonAndBin(t *testing.T) {
+	certs := newTestCerts(t)
+	tlsConf, err := cheshire.NewTLSConfig(certs.path("server.crt"), certs.path("server.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listeners := map[string]func(int, *cheshire.ServerConfig) error{
+		"json": cheshire.JsonListen,
+		"bin":  cheshire.BinaryListen,
+	}
+	for name, listen := range listeners {
+		_, port := startTLSServer(t, tlsConf, listen)
+		client := NewJson("127.0.0.1", port)
+		if name == "bin" {
+			client = NewBin("127.0.0.1", port)
+		}
+		client.PoolSize = 1
+		client.TLSConfig = &tls.Config{RootCAs: certs.pool}
+		err = client.Connect()
+		if err != nil {
+			t.Fatalf("%s: error connecting %s", name, err)
+		}
+		res, err := client.ApiCallSync(cheshire.NewRequest("/ping", "GET"), 5*time.Second)
+		if err != nil || res.StatusCode() != 200 {
+			t.Errorf("%s: expected a ping response, got %v %s", name, res, err)
+		}
+		client.Close()
+
+		//plaintext clients are refused
+		plain := NewJson("127.0.0.1", port)
+		plain.PoolSize = 1
+		if plain.Connect() == nil {
+			_, err = plain.ApiCallSync(cheshire.NewRequest("/ping", "GET"), 500*time.Millisecond)
+			if err == nil {
+				t.Errorf("%s: expected plaintext request to fail", name)
+			}
+			plain.Close()
+		}
+	}
+}
+
+func TestTLSHttp(t *testing.T) {
+	certs := newTestCerts(t)
+	tlsConf, err := cheshire.NewTLSConfig(certs.path("server.crt"), certs.path("server.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port := startTLSServer(t, tlsConf, cheshire.HttpListen)
+
+	client := NewHttp("https://127.0.0.1:" + strconv.Itoa(port))
+	if client.TLSConfig == nil {
+		t.Fatalf("Expected https address to enable tls")
+	}
+	client.TLSConfig.RootCAs = certs.pool
+	res, err := client.ApiCallSync(cheshire.NewRequest("/ping", "GET"), 5*time.Second)
+	if err != nil || res.StatusCode() != 200 {
+		t.Errorf("expected a ping response, got %v %s", res, err)
+	}
+}
+
+func TestTLSClientCert(t *testing.T) {
+	certs := newTestCerts(t)
+	tlsConf, err := cheshire.NewTLSConfig(certs.path("server.crt"), certs.path("server.key"), certs.path("ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port := startTLSServer(t, tlsConf, cheshire.JsonListen)
+
+	client := NewJson("127.0.0.1", port)
+	client.PoolSize = 1
+	client.TLSConfig = &tls.Config{RootCAs: certs.pool, Certificates: []tls.Certificate{certs.client}}
+	err = client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	res, err := client.ApiCallSync(cheshire.NewRequest("/ping", "GET"), 5*time.Second)
+	if err != nil || res.StatusCode() != 200 {
+		t.Errorf("expected a ping response, got %v %s", res, err)
+	}
+
+	//no client cert
+	anon := NewJson("127.0.0.1", port)
+	anon.PoolSize = 1
+	anon.TLSConfig = &tls.Config{RootCAs: certs.pool}
+	if anon.Connect() == nil {
+		_, err = anon.ApiCallSync(cheshire.NewRequest("/ping", "GET"), 500*time.Millisecond)
+		if err == nil {
+			t.Errorf("expected request without a client cert to fail")
+		}
+		anon.Close()
+	}
+}
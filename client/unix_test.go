@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"github.com/trendrr/goshire/cheshire"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Starts a json or bin server on a unix socket in a temp dir, returning
+// the socket path once the listener accepts connections.
+// stop shuts the server down, it is also called when the test ends.
+func startUnixServer(t *testing.T, proto string, conf *cheshire.ServerConfig) (string, func()) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), proto+".sock")
+	listen := cheshire.JsonListenUnix
+	if proto != "json" {
+		listen = cheshire.BinaryListenUnix
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- listen(path, conf)
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			conf.Shutdown(ctx)
+		})
+	}
+	t.Cleanup(stop)
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		select {
+		case err := <-errs:
+			t.Fatalf("%s listener stopped: %v", proto, err)
+		default:
+		}
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return path, stop
+		}
+	}
+	t.Fatalf("%s listener never accepted connections", proto)
+	return "", nil
+}
+
+func TestUnixSocket(t *testing.T) {
+	for _, name := range []string{"json", "bin", "msgpack"} {
+		conf := cheshire.NewServerConfig()
+		conf.Register([]string{"GET"}, cheshire.NewController("/ping", []string{"GET"}, cheshire.PingController))
+		path, stop := startUnixServer(t, name, conf)
+
+		client := NewJsonUnix(path)
+		if name != "json" {
+			client = NewBinUnix(path)
+		}
+		if name == "msgpack" {
+			client.ParamEncoding = "msgpack"
+			client.Negotiate = true
+		}
+		client.PoolSize = 1
+		err := client.Connect()
+		if err != nil {
+			t.Fatalf("%s: error connecting %s", name, err)
+		}
+		res, err := client.ApiCallSync(cheshire.NewRequest("/ping", "GET"), 5*time.Second)
+		if err != nil || res.StatusCode() != 200 {
+			t.Errorf("%s: expected a ping response, got %v %s", name, res, err)
+		}
+		client.Close()
+		stop()
+	}
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"crypto/tls"
+	"fmt"
+	"github.com/trendrr/goshire/cheshire"
+	"net"
+	"net/url"
+)
+
+// Dials the websocket url (ws:// or wss://).
+// The origin is the http url of the same host.
+// The binary protocol is negotiated with the strest-bin subprotocol
+func dialWebsocket(rawurl string, protocol cheshire.Protocol, tlsConfig *tls.Config) (net.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	origin := "http://" + u.Host
+	port := "80"
+	switch u.Scheme {
+	case "ws":
+		tlsConfig = nil
+	case "wss":
+		origin = "https://" + u.Host
+		port = "443"
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+	default:
+		return nil, fmt.Errorf("Bad websocket url %s", rawurl)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	config, err := websocket.NewConfig(rawurl, origin)
+	if err != nil {
+		return nil, err
+	}
+	if protocol.Type() == cheshire.BIN.Type() {
+		config.Protocol = []string{cheshire.WebsocketBinProtocol}
+	}
+	conn, err := dial("tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if protocol.Type() == cheshire.BIN.Type() {
+		ws.PayloadType = websocket.BinaryFrame
+	}
+	return ws, nil
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/trendrr/goshire/cheshire"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebsocketClient(t *testing.T) {
+	conf := cheshire.NewServerConfig()
+	conf.Register([]string{"GET"}, cheshire.NewController("/ping", []string{"GET"}, cheshire.PingController))
+	conf.Register([]string{"GET"}, cheshire.NewWebsocketController("/ws", conf))
+	port := freePort(t)
+	go cheshire.HttpListen(port, conf)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		conf.Shutdown(ctx)
+	}()
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	for i := 0; i < 100; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	url := fmt.Sprintf("ws://%s/ws", addr)
+	for _, client := range []*JsonClient{NewWebsocket(url), NewBinWebsocket(url)} {
+		client.PoolSize = 2
+		err := client.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		//txns are multiplexed over the pooled connections
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := client.ApiCallSync(cheshire.NewRequest("/ping", "GET"), 5*time.Second)
+				if err != nil || res.StatusCode() != 200 {
+					t.Errorf("%s: expected a ping response, got %v %s", client.protocol.Type(), res, err)
+				}
+			}()
+		}
+		wg.Wait()
+		client.Close()
+	}
+
+	bad := NewWebsocket(fmt.Sprintf("http://%s/ws", addr))
+	if bad.Connect() == nil {
+		t.Errorf("Expected an error connecting to a non websocket url")
+	}
+}
@@ -4,6 +4,7 @@ import (
     "log"
     "github.com/trendrr/goshire/cheshire"
     "github.com/trendrr/goshire/cheshire/impl/gocache"
+    "github.com/trendrr/goshire/closer"
     "runtime"
 )
 
@@ -73,7 +74,13 @@ func main() {
     }
     cheshire.RegisterHtml("/", "GET", sess)
 
+    //shut down cleanly on kill signal
+    closer.Register(bootstrap)
+
     log.Println("Starting")
     //starts listening on all configured interfaces
-    bootstrap.Start()
+    err := bootstrap.Start()
+    if err != nil {
+        log.Println(err)
+    }
 }